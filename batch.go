@@ -81,68 +81,89 @@ func (wb *WriteBatch) Commit() error {
 		return ErrExceedMaxBatchNum
 	}
 
-	//加锁保证事物提交串行化
-	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
-
-	//获取最新的事物SEQ
-	seqNo := atomic.AddInt64(&wb.db.seqNo, 1)
-
-	//磁盘位置暂存于此，等到全部写完后再写入Index-Table
-	positons := make(map[string]*data.LogRecordPos)
-
-	//开始写数据到数据文件
-	for _, record := range wb.pendingWrites {
-		logrecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   LogRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
-		})
-		if err != nil {
-			return err
+	//通过组提交串行化事务提交
+	return wb.db.commit(wb.newCommitRequest(nil))
+}
+
+// 构造提交请求：写入时分配事务序列号并生成带序列号的数据，持久化之后再更新Index-table
+// check 不为空时会在写入前调用，返回错误则放弃提交
+// （在访问此方法前必须持有 wb.mu，直到请求完成）
+func (wb *WriteBatch) newCommitRequest(check func() error) *commitRequest {
+	var seqNo int64
+	keys := make([]string, 0, len(wb.pendingWrites))
+
+	prepare := func() ([]*data.LogRecord, error) {
+		if check != nil {
+			if err := check(); err != nil {
+				return nil, err
+			}
 		}
-		positons[string(record.Key)] = logrecordPos
-	}
 
-	//追加一条标识事务完成的数据
-	finishedRecord := &data.LogRecord{
-		Key:  LogRecordKeyWithSeq(txnFinKey, seqNo),
-		Type: data.LogRecordTxnFinished,
-	}
+		//获取最新的事物SEQ
+		seqNo = atomic.AddInt64(&wb.db.seqNo, 1)
 
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
-		return err
-	}
+		records := make([]*data.LogRecord, 0, len(wb.pendingWrites)+1)
+		for key, record := range wb.pendingWrites {
+			keys = append(keys, key)
+			records = append(records, &data.LogRecord{
+				Key:   LogRecordKeyWithSeq(record.Key, seqNo),
+				Value: record.Value,
+				Type:  record.Type,
 
-	//根据配置决定是否持久化
-	if wb.options.SyncWrites && wb.db.activefile != nil {
-		if err := wb.db.activefile.Sync(); err != nil {
-			return err
+				Compression: wb.db.options.Compression,
+			})
 		}
+
+		//追加一条标识事务完成的数据
+		records = append(records, &data.LogRecord{
+			Key:  LogRecordKeyWithSeq(txnFinKey, seqNo),
+			Type: data.LogRecordTxnFinished,
+		})
+
+		//同一组中后提交的乐观事务需要能检测到与本批次的冲突
+		for _, key := range keys {
+			wb.db.trackSeqWriteLocked(seqNo, key)
+		}
+		return records, nil
 	}
 
-	//整个事物写入之后更新Index-table
-	for _, record := range wb.pendingWrites {
-		pos := positons[string(record.Key)]
-		var oldpos *data.LogRecordPos
-		if record.Type == data.LogRecordDeleted {
-			oldpos, _ = wb.db.index.Delete(record.Key)
-			if pos != nil {
-				wb.db.DeletedSize += int64(pos.Size)
+	apply := func(positions []*data.LogRecordPos) {
+		//整个事物写入之后更新Index-table
+		for i, key := range keys {
+			record, pos := wb.pendingWrites[key], positions[i]
+			var oldpos *data.LogRecordPos
+			wb.db.saveSnapshotPosLocked(record.Key)
+			if record.Type == data.LogRecordDeleted {
+				oldpos, _ = wb.db.index.Delete(record.Key)
+				wb.db.addDeletedSize(pos)
+			}
+			if record.Type == data.LogRecordNormal {
+				oldpos = wb.db.index.Put(record.Key, pos)
+			}
+			if oldpos != nil {
+				wb.db.addDeletedSize(oldpos)
 			}
 		}
-		if record.Type == data.LogRecordNormal {
-			oldpos = wb.db.index.Put(record.Key, pos)
-		}
-		if oldpos != nil {
-			wb.db.DeletedSize += int64(oldpos.Size)
+		//事务完成标记本身是无效数据
+		wb.db.addDeletedSize(positions[len(keys)])
+
+		//持久化期间可能有新的事务开始，索引更新之后需要重新记录修改
+		if len(wb.db.activeTxns) > 0 {
+			seqNo := atomic.AddInt64(&wb.db.seqNo, 1)
+			for _, key := range keys {
+				wb.db.trackSeqWriteLocked(seqNo, key)
+			}
 		}
-	}
 
-	//清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-	return nil
+		//清空暂存数据
+		wb.pendingWrites = make(map[string]*data.LogRecord)
+	}
 
+	return &commitRequest{
+		prepare: prepare,
+		apply:   apply,
+		sync:    wb.options.SyncWrites,
+	}
 }
 
 // key + seq Number编码
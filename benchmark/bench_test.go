@@ -3,8 +3,10 @@ package benchmark
 import (
 	bitcaskkvdb "bitcask"
 	"bitcask/utils"
+	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -74,6 +76,34 @@ func Benchmark_Get(b *testing.B) {
 	}
 }
 
+// 并发读取，观察 Get 随并发度的扩展情况
+func Benchmark_ParallelGet(b *testing.B) {
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(b, err)
+	}
+
+	//RunParallel 启动 parallelism*GOMAXPROCS 个 goroutine，标签中记录实际的 goroutine 数量
+	for _, parallelism := range []int{1, 4, 16, 64} {
+		goroutines := parallelism * runtime.GOMAXPROCS(0)
+		b.Run(fmt.Sprintf("goroutines-%d", goroutines), func(b *testing.B) {
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					_, err := db.Get(utils.GetTestKey(r.Intn(10000)))
+					if err != nil && err != bitcaskkvdb.ErrKeyNotFind {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
 func Benchmark_Delete(b *testing.B) {
 	b.ResetTimer()
 	b.ReportAllocs()
@@ -83,3 +113,27 @@ func Benchmark_Delete(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+// 小 Value 写入时比较标准文件 Io（pwrite）和可写内存映射
+func Benchmark_PutIoType(b *testing.B) {
+	for _, mmapWrite := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap-write-%v", mmapWrite), func(b *testing.B) {
+			options := bitcaskkvdb.DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-bench")
+			defer os.RemoveAll(dir)
+			options.Dirpath = dir
+			options.DataFileSize = 64 * 1024 * 1024
+			options.MMapWrite = mmapWrite
+			ioDB, err := bitcaskkvdb.Open(options)
+			assert.Nil(b, err)
+			defer ioDB.Close()
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := ioDB.Put(utils.GetTestKey(i), values[i%len(values)][:32])
+				assert.Nil(b, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	bitcaskkvdb "bitcask"
+	"bitcask/data"
+	"bitcask/fio"
+	"bitcask/index"
+	"bitcask/utils"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// 数据库运行时持有的文件锁
+const fileLockName = "flock"
+
+/*
+	离线检查数据目录的工具，使用前需要先关闭数据库，数据库正在运行时拒绝执行
+	verify、repair 和 dump 只读打开文件，不会修改被检查的文件
+
+	bitcask-tool verify <dir>           校验所有文件的 CRC，输出每个文件的统计信息
+	bitcask-tool repair <dir> <dest>    将所有有效数据拷贝到新的目录中
+	bitcask-tool dump [-values] <file>  输出文件中解码之后的每条数据
+	bitcask-tool upgrade <dir>          为没有文件头的旧格式文件加上文件头，中断之后可以重新执行
+
+	加密的数据目录需要通过环境变量 BITCASK_KEYS 提供密钥，格式为 id:hex[,id:hex...]
+	最后一个密钥作为当前密钥，repair 时用于加密新目录中的文件
+*/
+
+const usage = `usage:
+  bitcask-tool verify <dir>
+  bitcask-tool repair <dir> <dest>
+  bitcask-tool dump [-values] <file>
+  bitcask-tool upgrade <dir>
+
+encrypted directories need keys in BITCASK_KEYS=id:hex[,id:hex...]`
+
+// 从环境变量中读取的密钥，没有设置时为 nil
+var keys data.KeyProvider
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	provider, err := loadKeys(os.Getenv("BITCASK_KEYS"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+	if provider != nil {
+		keys = provider
+	}
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "verify":
+		err = runVerify(args)
+	case "repair":
+		err = runRepair(args)
+	case "dump":
+		err = runDump(args)
+	case "upgrade":
+		err = runUpgrade(args)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// 数据目录中的一个文件
+type dirFile struct {
+	name   string
+	fileId uint32 //只有数据文件和数据文件的 Hint 才有
+	isData bool
+	isHint bool //数据文件对应的 Hint 文件
+}
+
+// 列出数据目录中需要检查的文件，数据文件按id从小到大排在前面
+func listFiles(dir string) ([]dirFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []dirFile
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, data.DataFileNameSuffix):
+			fileId, err := strconv.Atoi(strings.TrimSuffix(name, data.DataFileNameSuffix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid data file name %s", name)
+			}
+			files = append(files, dirFile{name: name, fileId: uint32(fileId), isData: true})
+		case strings.HasSuffix(name, data.HintFileNameSuffix):
+			fileId, err := strconv.Atoi(strings.TrimSuffix(name, data.HintFileNameSuffix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid hint file name %s", name)
+			}
+			files = append(files, dirFile{name: name, fileId: uint32(fileId), isHint: true})
+		case name == data.HintFileName, name == data.SeqNoFileName, name == data.MergeFinishedFileName,
+			name == data.IndexSnapshotFileName:
+			files = append(files, dirFile{name: name})
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].isData != files[j].isData {
+			return files[i].isData
+		}
+		return files[i].fileId < files[j].fileId
+	})
+	return files, nil
+}
+
+// 解析 id:hex[,id:hex...] 格式的密钥
+func loadKeys(spec string) (*bitcaskkvdb.StaticKeyProvider, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var provider *bitcaskkvdb.StaticKeyProvider
+	for _, item := range strings.Split(spec, ",") {
+		idStr, keyHex, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid key %q,want id:hex", item)
+		}
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key id %q", idStr)
+		}
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d: %v", id, err)
+		}
+		if provider == nil {
+			provider = bitcaskkvdb.NewStaticKeyProvider(uint32(id), key)
+		} else {
+			provider.AddKey(uint32(id), key, true)
+		}
+	}
+	return provider, nil
+}
+
+// 获取数据目录的文件锁，数据库正在运行时返回错误
+func lockDir(dir string) (*flock.Flock, error) {
+	fileLock := flock.New(filepath.Join(dir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, fmt.Errorf("database %s is using", dir)
+	}
+	return fileLock, nil
+}
+
+// 只读打开文件，不会创建文件，也不会修复文件头
+func openFile(dir string, file dirFile) (*data.DataFile, error) {
+	fileKeys := keys
+	if file.name == data.MergeFinishedFileName {
+		fileKeys = nil
+	}
+	return data.OpenFileForInspect(filepath.Join(dir, file.name), file.fileId, fileKeys)
+}
+
+// 在 repair 的目标目录中创建文件
+func createFile(dir string, file dirFile) (*data.DataFile, error) {
+	if file.isData {
+		return data.OpenDataFile(dir, file.fileId, fio.StandardFio, keys)
+	}
+	return data.OpenSeqNoFile(dir, keys)
+}
+
+// 一处损坏的数据
+type corruption struct {
+	offset int64
+	size   int64
+	err    error
+}
+
+// 遍历文件中的所有有效数据，遇到损坏时逐字节向后查找下一条有效数据
+func scanFile(df *data.DataFile, fn func(record *data.LogRecord, offset, size int64) error) ([]corruption, error) {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	var corruptions []corruption
+	var offset = df.DataOffset()
+	for offset < fileSize {
+		record, size, err := df.ReadRecord(offset)
+		if err == nil {
+			if err := fn(record, offset, size); err != nil {
+				return nil, err
+			}
+			offset += size
+			continue
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		next := offset + 1
+		for ; next < fileSize; next++ {
+			if _, _, err := df.ReadRecord(next); err == nil {
+				break
+			}
+		}
+		corruptions = append(corruptions, corruption{offset: offset, size: next - offset, err: err})
+		offset = next
+	}
+	return corruptions, nil
+}
+
+// 分开数据文件中 key 的事务序列号和真正的 key
+func parseKey(key []byte) ([]byte, uint64) {
+	seqNo, n := binary.Uvarint(key)
+	if n <= 0 {
+		return key, 0
+	}
+	return key[n:], seqNo
+}
+
+func typeName(typ data.LogRecordType) string {
+	switch typ {
+	case data.LogRecordNormal:
+		return "normal"
+	case data.LogRecordDeleted:
+		return "deleted"
+	case data.LogRecordTxnFinished:
+		return "txn-finished"
+	default:
+		return "unknown(" + strconv.Itoa(int(typ)) + ")"
+	}
+}
+
+func runVerify(args []string) error {
+	if len(args) != 1 {
+		return errors.New(usage)
+	}
+	dir := args[0]
+	fileLock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var corrupted int
+	for _, file := range files {
+		df, err := openFile(dir, file)
+		if err != nil {
+			//文件头损坏时无法读取其中的数据，只报告错误
+			fmt.Printf("%-20s unreadable: %v\n", file.name, err)
+			corrupted++
+			continue
+		}
+		size, err := df.IoManager.Size()
+		if err != nil {
+			_ = df.Close()
+			return err
+		}
+		version := "legacy"
+		if df.Header != nil {
+			version = strconv.Itoa(int(df.Header.Version))
+		} else if size == 0 {
+			version = "empty"
+		}
+		if df.Encrypted() {
+			version += fmt.Sprintf(" key=%d", df.KeyId())
+		}
+		var records, bytes int64
+		counts := make(map[data.LogRecordType]int64)
+		corruptions, err := scanFile(df, func(record *data.LogRecord, offset, size int64) error {
+			records++
+			bytes += size
+			counts[record.Type]++
+			return nil
+		})
+		_ = df.Close()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%-20s version=%s records=%d bytes=%d", file.name, version, records, bytes)
+		if file.isData {
+			fmt.Printf(" normal=%d deleted=%d txn-finished=%d",
+				counts[data.LogRecordNormal], counts[data.LogRecordDeleted], counts[data.LogRecordTxnFinished])
+		}
+		fmt.Printf(" corrupted=%d\n", len(corruptions))
+		for _, c := range corruptions {
+			fmt.Printf("  corrupted at offset %d, %d bytes: %v\n", c.offset, c.size, c.err)
+		}
+		if len(corruptions) > 0 {
+			corrupted++
+		}
+	}
+
+	if corrupted > 0 {
+		return fmt.Errorf("%d of %d files are corrupted", corrupted, len(files))
+	}
+	fmt.Printf("all %d files are valid\n", len(files))
+	return nil
+}
+
+// 将数据文件和事务序列号文件中的有效数据拷贝到新的目录中
+// Hint文件中的位置在拷贝之后不再有效，启动时会从数据文件重建索引
+func runRepair(args []string) error {
+	if len(args) != 2 {
+		return errors.New(usage)
+	}
+	dir, dest := args[0], args[1]
+	fileLock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return fmt.Errorf("destination %s is not empty", dest)
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.isData && file.name != data.SeqNoFileName {
+			continue
+		}
+		src, err := openFile(dir, file)
+		if err != nil {
+			return err
+		}
+		dst, err := createFile(dest, file)
+		if err != nil {
+			_ = src.Close()
+			return err
+		}
+
+		var salvaged int64
+		corruptions, err := scanFile(src, func(record *data.LogRecord, offset, size int64) error {
+			salvaged++
+			encRecord, _ := dst.EncodeRecord(record)
+			return dst.Write(encRecord)
+		})
+		if err == nil {
+			err = dst.Sync()
+		}
+		_ = src.Close()
+		_ = dst.Close()
+		if err != nil {
+			return err
+		}
+
+		var dropped int64
+		for _, c := range corruptions {
+			dropped += c.size
+		}
+		fmt.Printf("%-20s salvaged=%d dropped_bytes=%d\n", file.name, salvaged, dropped)
+	}
+	return nil
+}
+
+func runDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	values := flags.Bool("values", false, "print values")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(usage)
+	}
+	path := flags.Arg(0)
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	fileLock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+	var file *dirFile
+	for i := range files {
+		if files[i].name == name {
+			file = &files[i]
+		}
+	}
+	if file == nil {
+		return fmt.Errorf("%s is not a bitcask file", path)
+	}
+
+	df, err := openFile(dir, *file)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	corruptions, err := scanFile(df, func(record *data.LogRecord, offset, size int64) error {
+		fmt.Printf("offset=%d size=%d type=%s", offset, size, typeName(record.Type))
+		switch {
+		case file.isData:
+			key, seqNo := parseKey(record.Key)
+			fmt.Printf(" seq=%d key=%q", seqNo, key)
+		case file.isHint:
+			if dataSize, ok := data.DecodeHintEnd(record); ok {
+				fmt.Printf(" hint-end data_size=%d", dataSize)
+				break
+			}
+			key, seqNo := parseKey(record.Key)
+			pos := data.DecodeLogRecordPos(record.Value)
+			fmt.Printf(" seq=%d key=%q pos_offset=%d pos_size=%d", seqNo, key, pos.Offset, pos.Size)
+			if pos.ExpireAt > 0 {
+				fmt.Printf(" expire_at=%s", time.Unix(0, pos.ExpireAt).Format(time.RFC3339Nano))
+			}
+		case file.name == data.IndexSnapshotFileName && len(record.Key) == 0:
+			fmt.Printf(" snapshot-meta value_len=%d", len(record.Value))
+		case file.name == data.HintFileName, file.name == data.IndexSnapshotFileName:
+			pos := data.DecodeLogRecordPos(record.Value)
+			fmt.Printf(" key=%q fid=%d pos_offset=%d pos_size=%d", record.Key, pos.Fid, pos.Offset, pos.Size)
+		default:
+			fmt.Printf(" key=%q value=%q", record.Key, record.Value)
+		}
+		if record.ExpireAt > 0 {
+			fmt.Printf(" expire_at=%s", time.Unix(0, record.ExpireAt).Format(time.RFC3339Nano))
+		}
+		if file.isData {
+			switch record.Compression {
+			case data.CompressionSnappy:
+				fmt.Printf(" compression=snappy")
+			case data.CompressionDeflate:
+				fmt.Printf(" compression=deflate")
+			case data.CompressionZstd:
+				fmt.Printf(" compression=zstd")
+			}
+			fmt.Printf(" value_len=%d", len(record.Value))
+			if *values {
+				fmt.Printf(" value=%q", record.Value)
+			}
+		}
+		fmt.Println()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range corruptions {
+		fmt.Printf("corrupted at offset %d, %d bytes: %v\n", c.offset, c.size, c.err)
+	}
+	return nil
+}
+
+// 记录升级开始时旧格式数据文件id的文件，升级完成之后删除
+const upgradePlanName = "upgrade-plan"
+
+// 为旧格式文件加上文件头，数据文件中每条数据的位置都向后移动了文件头的长度
+// 所以Hint文件和B+树索引中指向这些数据文件的位置也需要一起修改
+// 所有的位置在改写任何文件之前计算好，之后只是逐个替换文件，中断之后重新执行会从中断的地方继续
+func runUpgrade(args []string) error {
+	if len(args) != 1 {
+		return errors.New(usage)
+	}
+	dir := args[0]
+	fileLock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	//上次升级被中断时，已经改写的数据文件有了文件头，需要使用升级开始时记录的文件id
+	upgradedIds, resumed, err := loadUpgradePlan(dir)
+	if err != nil {
+		return err
+	}
+
+	//找出所有旧格式文件
+	legacy := make(map[string]bool)
+	var hintFile *dirFile
+	for i, file := range files {
+		if file.name == data.HintFileName {
+			hintFile = &files[i]
+		}
+		df, err := openFile(dir, file)
+		if err != nil {
+			return err
+		}
+		if df.Header == nil {
+			legacy[file.name] = true
+			if file.isData && !resumed {
+				upgradedIds[file.fileId] = true
+			}
+		}
+		_ = df.Close()
+	}
+	if !resumed && len(legacy) == 0 {
+		return nil
+	}
+
+	if !resumed {
+		//B+树索引中记录了已经移动过的数据文件，记录升级计划之前中断时不会重复移动
+		shifted, err := index.ShiftBPlusTreePositions(dir, upgradedIds, data.FileHeaderSize)
+		if err != nil {
+			return err
+		}
+		if shifted > 0 {
+			fmt.Printf("%-20s upgraded %d positions\n", "bptree-index", shifted)
+		}
+
+		//新的Hint文件先写入临时文件，数据文件全部改写之后再替换
+		if hintFile != nil && (legacy[hintFile.name] || len(upgradedIds) > 0) {
+			content, err := shiftHintFile(dir, *hintFile, upgradedIds)
+			if err != nil {
+				return err
+			}
+			if _, err := writeTmpFile(dir, hintFile.name, withHeader(content)); err != nil {
+				return err
+			}
+		}
+
+		if err := writeUpgradePlan(dir, upgradedIds); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		if file.name == data.HintFileName || !legacy[file.name] {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, file.name))
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(dir, file.name, withHeader(content)); err != nil {
+			return err
+		}
+		fmt.Printf("%-20s upgraded\n", file.name)
+	}
+
+	//Hint文件需要在数据文件之后替换
+	tmpName := filepath.Join(dir, data.HintFileName+".upgrade")
+	if _, err := os.Stat(tmpName); err == nil {
+		if err := os.Rename(tmpName, filepath.Join(dir, data.HintFileName)); err != nil {
+			return err
+		}
+		if err := utils.SyncDir(dir); err != nil {
+			return err
+		}
+		fmt.Printf("%-20s upgraded\n", data.HintFileName)
+	}
+
+	if err := index.FinishBPlusTreeShift(dir); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, upgradePlanName)); err != nil {
+		return err
+	}
+	return utils.SyncDir(dir)
+}
+
+// 读取升级计划，没有未完成的升级时返回空的集合和 false
+func loadUpgradePlan(dir string) (map[uint32]bool, bool, error) {
+	ids := make(map[uint32]bool)
+	content, err := os.ReadFile(filepath.Join(dir, upgradePlanName))
+	if os.IsNotExist(err) {
+		return ids, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	for _, field := range strings.Fields(string(content)) {
+		fileId, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s: %v", upgradePlanName, err)
+		}
+		ids[uint32(fileId)] = true
+	}
+	return ids, true, nil
+}
+
+// 记录需要升级的数据文件id
+func writeUpgradePlan(dir string, fileIds map[uint32]bool) error {
+	var content []byte
+	for fileId := range fileIds {
+		content = strconv.AppendUint(content, uint64(fileId), 10)
+		content = append(content, '\n')
+	}
+	return replaceFile(dir, upgradePlanName, content)
+}
+
+// 读取Hint文件，返回移动了位置之后的数据，不包括文件头
+func shiftHintFile(dir string, hintFile dirFile, upgradedIds map[uint32]bool) ([]byte, error) {
+	df, err := openFile(dir, hintFile)
+	if err != nil {
+		return nil, err
+	}
+	defer df.Close()
+	var content []byte
+	corruptions, err := scanFile(df, func(record *data.LogRecord, offset, size int64) error {
+		pos := data.DecodeLogRecordPos(record.Value)
+		if upgradedIds[pos.Fid] {
+			pos.Offset += data.FileHeaderSize
+		}
+		encRecord, _ := data.Encode_LogRecord(&data.LogRecord{Key: record.Key, Value: data.Encode_LogRecordPos(pos)})
+		content = append(content, encRecord...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(corruptions) > 0 {
+		return nil, fmt.Errorf("%s is corrupted,remove it and the index will be rebuilt from data files", hintFile.name)
+	}
+	return content, nil
+}
+
+// 在数据之前加上当前版本的文件头
+func withHeader(content []byte) []byte {
+	header := data.EncodeFileHeader(&data.FileHeader{
+		Version:  data.FileFormatVersion,
+		CreateAt: time.Now().UnixNano(),
+	})
+	return append(header, content...)
+}
+
+// 将数据写入临时文件并持久化，返回临时文件名
+func writeTmpFile(dir, name string, content []byte) (string, error) {
+	tmpName := filepath.Join(dir, name+".upgrade")
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFileperm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	return tmpName, file.Close()
+}
+
+// 将数据写入临时文件，再替换原来的文件
+func replaceFile(dir, name string, content []byte) error {
+	tmpName, err := writeTmpFile(dir, name, content)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return utils.SyncDir(dir)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	bitcaskkvdb "bitcask"
+	"bitcask/data"
+	"bitcask/index"
+	"bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 检查命令只读打开文件，空文件和文件头不完整的文件原样保留
+func TestVerifyDoesNotModifyFiles(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-tool")
+	defer os.RemoveAll(dir)
+	opts := bitcaskkvdb.DefaultOptions
+	opts.Dirpath = dir
+	db, err := bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+
+	//数据库运行时拒绝执行
+	assert.NotNil(t, runVerify([]string{dir}))
+	assert.NotNil(t, runDump([]string{data.GetDataFileName(dir, 0)}))
+	assert.Nil(t, db.Close())
+	assert.Nil(t, runVerify([]string{dir}))
+
+	emptyName := data.GetDataFileName(dir, 7)
+	tornName := data.GetHintFileName(dir, 8)
+	assert.Nil(t, os.WriteFile(emptyName, nil, 0644))
+	assert.Nil(t, os.WriteFile(tornName, []byte("BCKV"), 0644))
+	sizes := func() map[string]int64 {
+		entries, err := os.ReadDir(dir)
+		assert.Nil(t, err)
+		result := make(map[string]int64)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			assert.Nil(t, err)
+			result[entry.Name()] = info.Size()
+		}
+		return result
+	}
+	before := sizes()
+
+	//文件头不完整的文件被报告为损坏
+	assert.NotNil(t, runVerify([]string{dir}))
+	assert.Nil(t, runDump([]string{emptyName}))
+	assert.NotNil(t, runDump([]string{tornName}))
+	assert.Equal(t, before, sizes())
+
+	//修复时跳过无法读取的 Hint 文件，数据文件中的数据全部保留
+	assert.Nil(t, os.Remove(tornName))
+	dest := filepath.Join(dir, "repaired")
+	defer os.RemoveAll(dest)
+	assert.Nil(t, runRepair([]string{dir, dest}))
+	opts.Dirpath = dest
+	db, err = bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
+
+// 升级使用B+树索引的旧格式数据目录，索引中的位置和数据文件一起移动
+func TestUpgradeBPlusTree(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-tool")
+	defer os.RemoveAll(dir)
+	opts := bitcaskkvdb.DefaultOptions
+	opts.Dirpath = dir
+	opts.IndexType = bitcaskkvdb.BPlusTree
+	opts.DataFileSize = 4 * 1024
+	db, err := bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i+1000)))
+	}
+	assert.Nil(t, db.Close())
+
+	downgradeDir(t, dir)
+
+	//重复执行不会再次移动位置
+	assert.Nil(t, runUpgrade([]string{dir}))
+	assert.Nil(t, runUpgrade([]string{dir}))
+
+	db, err = bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i+1000), val)
+	}
+}
+
+// 去掉所有文件的文件头，并把Hint文件和B+树索引中的位置移回去，构造旧格式的数据目录
+// 旧格式没有数据文件对应的 Hint 文件，直接删除
+func downgradeDir(t *testing.T, dir string) {
+	files, err := listFiles(dir)
+	assert.Nil(t, err)
+	fileIds := make(map[uint32]bool)
+	for _, file := range files {
+		if file.isData {
+			fileIds[file.fileId] = true
+		}
+	}
+	assert.Greater(t, len(fileIds), 1)
+	for _, file := range files {
+		fileName := filepath.Join(dir, file.name)
+		switch {
+		case file.isHint:
+			assert.Nil(t, os.Remove(fileName))
+		case file.name == data.HintFileName:
+			df, err := openFile(dir, file)
+			assert.Nil(t, err)
+			var content []byte
+			_, err = scanFile(df, func(record *data.LogRecord, offset, size int64) error {
+				pos := data.DecodeLogRecordPos(record.Value)
+				pos.Offset -= data.FileHeaderSize
+				encRecord, _ := data.Encode_LogRecord(&data.LogRecord{Key: record.Key, Value: data.Encode_LogRecordPos(pos)})
+				content = append(content, encRecord...)
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Nil(t, df.Close())
+			assert.Nil(t, os.WriteFile(fileName, content, 0644))
+		default:
+			content, err := os.ReadFile(fileName)
+			assert.Nil(t, err)
+			assert.Nil(t, os.WriteFile(fileName, content[data.FileHeaderSize:], 0644))
+		}
+	}
+	_, err = index.ShiftBPlusTreePositions(dir, fileIds, -data.FileHeaderSize)
+	assert.Nil(t, err)
+	assert.Nil(t, index.FinishBPlusTreeShift(dir))
+}
+
+// 升级在改写数据文件的途中被中断，重新执行时从中断的地方继续，Hint文件中的位置只移动一次
+func TestUpgradeResume(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-tool")
+	defer os.RemoveAll(dir)
+	opts := bitcaskkvdb.DefaultOptions
+	opts.Dirpath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 400; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%200), utils.RandomValue(16)))
+	}
+	//Merge 生成 Hint 文件，之后写入的数据在 Merge 之后的数据文件中
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%100), utils.RandomValue(16)))
+	}
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(150+i)))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	expected := make(map[string][]byte)
+	assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+		expected[string(key)] = value
+		return true
+	}))
+	deletedSize := db.Stat().DeletedSize
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, data.HintFileName))
+	assert.Nil(t, err)
+
+	downgradeDir(t, dir)
+
+	//最后一个数据文件的临时文件无法创建，升级在改写了前面的数据文件之后中断
+	files, err := listFiles(dir)
+	assert.Nil(t, err)
+	var lastData dirFile
+	for _, file := range files {
+		if file.isData {
+			lastData = file
+		}
+	}
+	blocker := filepath.Join(dir, lastData.name+".upgrade")
+	assert.Nil(t, os.Mkdir(blocker, os.ModePerm))
+	assert.NotNil(t, runUpgrade([]string{dir}))
+	_, err = os.Stat(filepath.Join(dir, upgradePlanName))
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.Remove(blocker))
+	assert.Nil(t, runUpgrade([]string{dir}))
+	assert.Nil(t, runUpgrade([]string{dir}))
+	_, err = os.Stat(filepath.Join(dir, upgradePlanName))
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = bitcaskkvdb.Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, len(expected), len(db.ListKeys()))
+	for key, value := range expected {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Equal(t, deletedSize, db.Stat().DeletedSize)
+}
@@ -0,0 +1,266 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/fio"
+	"bitcask/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 将标准文件 Io 替换为注入故障的实现，返回的函数恢复原来的实现
+func injectFaults() (*fio.FaultInjector, func()) {
+	standard := fio.IoManagerFactory(fio.StandardFio)
+	fi := fio.NewFaultInjector(standard)
+	fio.RegisterIoManager(fio.StandardFio, fi.Factory())
+	return fi, func() {
+		fio.RegisterIoManager(fio.StandardFio, standard)
+	}
+}
+
+// 模拟崩溃并释放数据库，之后使用正常的 Io 重新打开
+func crashAndReopen(t *testing.T, db *DB, fi *fio.FaultInjector, restore func()) *DB {
+	assert.Nil(t, fi.Crash())
+	_ = db.Close()
+	restore()
+	db2, err := Open(db.options)
+	assert.Nil(t, err)
+	return db2
+}
+
+func TestWriteBatch_CommitCrash(t *testing.T) {
+	const batchSize = 10
+	//批次中的每条数据和事务完成标记各写入一次
+	for failAt := 0; failAt <= batchSize+1; failAt++ {
+		for _, short := range []bool{false, true} {
+			t.Run(fmt.Sprintf("fail-%d-short-%v", failAt, short), func(t *testing.T) {
+				fi, restore := injectFaults()
+				defer restore()
+
+				opts := DefaultOptions
+				dir, _ := os.MkdirTemp("", "bitcask-go")
+				opts.Dirpath = dir
+				db, err := Open(opts)
+				assert.Nil(t, err)
+				for i := 0; i < batchSize; i++ {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+				}
+				assert.Nil(t, db.Sync())
+
+				wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+				for i := 0; i < batchSize; i++ {
+					assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("new")))
+				}
+				assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+				fi.FailWritesAfter(failAt, short)
+				err = wb.Commit()
+				committed := failAt > batchSize
+				if committed {
+					assert.Nil(t, err)
+				} else {
+					assert.Equal(t, fio.ErrInjectedFault, err)
+				}
+
+				//失败的批次不影响之后的写入
+				fi.Heal()
+				assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+				assert.Nil(t, db.Sync())
+
+				db2 := crashAndReopen(t, db, fi, restore)
+				defer destroyDB(db2)
+
+				//批次中的数据要么全部可见，要么全部不可见
+				_, err = db2.Get(utils.GetTestKey(0))
+				if committed {
+					assert.Equal(t, ErrKeyNotFind, err)
+				} else {
+					assert.Nil(t, err)
+				}
+				for i := 1; i < batchSize; i++ {
+					val, err := db2.Get(utils.GetTestKey(i))
+					assert.Nil(t, err)
+					if committed {
+						assert.Equal(t, []byte("new"), val)
+					} else {
+						assert.Equal(t, []byte("old"), val)
+					}
+				}
+				val, err := db2.Get([]byte("after"))
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("value"), val)
+				assert.Equal(t, 0, len(db2.RecoveryReport().Corruptions))
+			})
+		}
+	}
+}
+
+func TestWriteBatch_CommitCrashBeforeSync(t *testing.T) {
+	fi, restore := injectFaults()
+	defer restore()
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("synced"), []byte("value")))
+	assert.Nil(t, db.Sync())
+
+	//不持久化的批次在崩溃之后丢失
+	wb := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: 100, SyncWrites: false})
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	assert.Nil(t, wb.Commit())
+	//持久化的批次在崩溃之后仍然存在，同时会持久化之前写入的数据
+	wb2 := db.NewWriteBatch(DefalutWriteBatchOptions)
+	assert.Nil(t, wb2.Put([]byte("durable"), []byte("value")))
+	assert.Nil(t, wb2.Commit())
+	wb3 := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: 100, SyncWrites: false})
+	assert.Nil(t, wb3.Put([]byte("lost"), []byte("value")))
+	assert.Nil(t, wb3.Commit())
+
+	db2 := crashAndReopen(t, db, fi, restore)
+	defer destroyDB(db2)
+	assert.Equal(t, 12, len(db2.ListKeys()))
+	_, err = db2.Get([]byte("durable"))
+	assert.Nil(t, err)
+	_, err = db2.Get([]byte("lost"))
+	assert.Equal(t, ErrKeyNotFind, err)
+}
+
+func TestDB_MergeCrash(t *testing.T) {
+	prepare := func(t *testing.T) (*DB, map[string][]byte) {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.DataFileSize = 8 * 1024
+		opts.DataFileMergeRatio = 0
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		expected := make(map[string][]byte)
+		for i := 0; i < 400; i++ {
+			key, value := utils.GetTestKey(i%200), utils.RandomValue(32)
+			assert.Nil(t, db.Put(key, value))
+			expected[string(key)] = value
+		}
+		for i := 0; i < 50; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(expected, string(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, db.Sync())
+		return db, expected
+	}
+	check := func(t *testing.T, db *DB, expected map[string][]byte) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+	}
+
+	//后台生成 Hint 文件的写入次数不固定，不注入故障
+	skipHint := func(fileName string) bool {
+		return !strings.HasSuffix(fileName, data.HintFileNameSuffix)
+	}
+
+	//先完整执行一次，统计 Merge 的写入次数
+	fi, restore := injectFaults()
+	fi.Filter(skipHint)
+	db, expected := prepare(t)
+	before := fi.Writes()
+	assert.Nil(t, db.Merge())
+	total := fi.Writes() - before
+	db2 := crashAndReopen(t, db, fi, restore)
+	check(t, db2, expected)
+	destroyDB(db2)
+	assert.Greater(t, total, 10)
+
+	//最后写入的是 merge-finished 文件（文件头和两条记录），以及临时实例关闭时的序列号文件
+	//序列号文件写入失败不影响 Merge 的结果
+	for _, failAt := range []int{0, 1, total / 3, total / 2, total - 5, total - 3} {
+		for _, short := range []bool{false, true} {
+			t.Run(fmt.Sprintf("fail-%d-short-%v", failAt, short), func(t *testing.T) {
+				fi, restore := injectFaults()
+				defer restore()
+				fi.Filter(skipHint)
+				db, expected := prepare(t)
+
+				fi.FailWritesAfter(failAt, short)
+				assert.NotNil(t, db.Merge())
+				//失败的 Merge 不影响读取
+				check(t, db, expected)
+				fi.Heal()
+
+				db2 := crashAndReopen(t, db, fi, restore)
+				defer destroyDB(db2)
+				check(t, db2, expected)
+
+				//重启之后可以再次 Merge
+				assert.Nil(t, db2.Merge())
+				check(t, db2, expected)
+			})
+		}
+	}
+}
+
+// 关闭时写入序列号文件失败，重启之后仍然能读到上一次关闭时保存的序列号
+func TestDB_CloseCrash(t *testing.T) {
+	for _, failAt := range []int{0, 1} {
+		for _, short := range []bool{false, true} {
+			t.Run(fmt.Sprintf("fail-%d-short-%v", failAt, short), func(t *testing.T) {
+				opts := DefaultOptions
+				dir, _ := os.MkdirTemp("", "bitcask-go")
+				opts.Dirpath = dir
+				//B+树索引启动时不读取数据文件，事务序列号只保存在序列号文件中
+				opts.IndexType = BPlusTree
+				opts.MMapOpen = false
+				commit := func(db *DB, i int) {
+					wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+					assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+					assert.Nil(t, wb.Commit())
+				}
+				//第一次关闭之后才有序列号文件，之后才能使用批量写入
+				db, err := Open(opts)
+				assert.Nil(t, err)
+				assert.Nil(t, db.Put(utils.GetTestKey(100), utils.RandomValue(10)))
+				assert.Nil(t, db.Close())
+				db, err = Open(opts)
+				assert.Nil(t, err)
+				for i := 0; i < 3; i++ {
+					commit(db, i)
+				}
+				assert.Nil(t, db.Close())
+
+				fi, restore := injectFaults()
+				defer restore()
+				db, err = Open(opts)
+				assert.Nil(t, err)
+				commit(db, 3)
+				fi.FailWritesAfter(failAt, short)
+				assert.NotNil(t, db.Close())
+				fi.Heal()
+
+				db2 := crashAndReopen(t, db, fi, restore)
+				defer destroyDB(db2)
+				assert.Equal(t, int64(3), db2.seqNo)
+
+				//再次关闭时覆盖残留的临时文件，并替换掉序列号文件
+				assert.Nil(t, os.WriteFile(filepath.Join(dir, data.SeqNoTmpFileName), []byte("BCKV"), 0644))
+				assert.Nil(t, db2.Close())
+				_, err = os.Stat(filepath.Join(dir, data.SeqNoTmpFileName))
+				assert.True(t, os.IsNotExist(err))
+				db3, err := Open(opts)
+				assert.Nil(t, err)
+				defer destroyDB(db3)
+				assert.Equal(t, int64(3), db3.seqNo)
+			})
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+type CompressionType = byte
+
+const (
+	//不压缩
+	CompressionNone CompressionType = iota
+
+	//Snappy 块格式，压缩和解压速度快，使用 s2 库写出兼容 Snappy 的格式
+	CompressionSnappy
+
+	//Deflate，压缩率更高，速度较慢
+	CompressionDeflate
+
+	//Zstandard，纯 Go 实现，压缩率接近 Deflate，解压速度接近 Snappy
+	CompressionZstd
+)
+
+var ErrUnsupportedCompression = errors.New("unsupported compression type")
+
+// 小于该长度的 Value 不压缩
+const minCompressSize = 64
+
+var (
+	flateWriterPool = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	flateReaderPool = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+
+	//zstd 的 Encoder 和 Decoder 可以被多个 goroutine 同时使用 EncodeAll/DecodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// 压缩 Value，压缩之后没有变小时返回 false，此时保存原始数据
+func compressValue(tp CompressionType, value []byte) ([]byte, bool) {
+	if len(value) < minCompressSize {
+		return value, false
+	}
+	var compressed []byte
+	switch tp {
+	case CompressionSnappy:
+		compressed = s2.EncodeSnappy(nil, value)
+	case CompressionDeflate:
+		var buf bytes.Buffer
+		w := flateWriterPool.Get().(*flate.Writer)
+		w.Reset(&buf)
+		_, _ = w.Write(value)
+		_ = w.Close()
+		flateWriterPool.Put(w)
+		compressed = buf.Bytes()
+	case CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(value, make([]byte, 0, len(value)))
+	default:
+		return value, false
+	}
+	if len(compressed) >= len(value) {
+		return value, false
+	}
+	return compressed, true
+}
+
+// 解压 Value
+func decompressValue(tp CompressionType, value []byte) ([]byte, error) {
+	switch tp {
+	case CompressionNone:
+		return value, nil
+	case CompressionSnappy:
+		return s2.Decode(nil, value)
+	case CompressionDeflate:
+		r := flateReaderPool.Get().(io.ReadCloser)
+		defer flateReaderPool.Put(r)
+		if err := r.(flate.Resetter).Reset(bytes.NewReader(value), nil); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(value, nil)
+	default:
+		return nil, ErrUnsupportedCompression
+	}
+}
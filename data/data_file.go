@@ -2,18 +2,24 @@ package data
 
 import (
 	"bitcask/fio"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"sync/atomic"
 )
 
 const (
 	DataFileNameSuffix    = ".data"
+	HintFileNameSuffix    = ".hint"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	SeqNoTmpFileName      = "seq-no.tmp"
+	IndexSnapshotFileName = "index-snapshot"
 )
 
 var ErrInvalidCrc = errors.New("Invalid Crc,log Record may be corrupted")
@@ -25,46 +31,107 @@ type DataFile struct {
 	Writeoff int64 //文件写入偏移
 
 	IoManager fio.IOManager //Io读写接口，通过此接口进行文件的读写
+	DeadSize  int64         //文件中无效数据的字节数，由存储引擎维护
+	Header    *FileHeader   //文件头，旧格式的文件为 nil
+	readOnly  bool          //是否以内存映射的方式只读打开
+	inspect   bool          //是否为离线检查而打开，不写入也不修复文件头
+	keys      KeyProvider   //密钥来源，为 nil 时不加密
+	aead      cipher.AEAD   //加密文件使用的密钥
+
+	refs    int32 //正在读取该文件的读者和快照个数
+	retired int32 //是否已经被 Merge 淘汰，引用归零后关闭
+	closed  int32 //是否已经因淘汰而关闭
 }
 
 func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
-func newDataFile(fileName string, fileId uint32, iotype fio.FileIoType) (*DataFile, error) {
+// GetHintFileName 数据文件对应的 Hint 文件，由封存的数据文件生成
+func GetHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+HintFileNameSuffix)
+}
+
+func newDataFile(fileName string, fileId uint32, iotype fio.FileIoType, keys KeyProvider) (*DataFile, error) {
 	ioManager, err := fio.NewIoManager(fileName, iotype)
 	if err != nil {
 		return nil, err
 	}
-	return &DataFile{
+	dataFile := &DataFile{
 		FileId:    fileId,
 		Writeoff:  0,
 		IoManager: ioManager,
-	}, nil
+		readOnly:  iotype == fio.MemoryMap,
+		keys:      keys,
+	}
+	if err := dataFile.loadHeader(fileName); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// OpenFileForInspect 只读打开已经存在的文件用于离线检查
+// 不会创建文件，空文件不写入文件头，文件头不完整时返回错误而不是截断文件
+func OpenFileForInspect(fileName string, fileId uint32, keys KeyProvider) (*DataFile, error) {
+	ioManager, err := fio.NewReadOnlyFileIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	dataFile := &DataFile{
+		FileId:    fileId,
+		IoManager: ioManager,
+		readOnly:  true,
+		inspect:   true,
+		keys:      keys,
+	}
+	if err := dataFile.loadHeader(fileName); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
 }
 
-// 打开新的数据文件
-func OpenDataFile(dirpath string, fileid uint32, iotype fio.FileIoType) (*DataFile, error) {
+// 打开新的数据文件，keys 为 nil 时不加密
+func OpenDataFile(dirpath string, fileid uint32, iotype fio.FileIoType, keys KeyProvider) (*DataFile, error) {
 	fileName := GetDataFileName(dirpath, fileid)
-	return newDataFile(fileName, fileid, iotype)
+	return newDataFile(fileName, fileid, iotype, keys)
 }
 
 // 打开Hint索引文件
-func OpenHintFile(dirpath string) (*DataFile, error) {
+func OpenHintFile(dirpath string, keys KeyProvider) (*DataFile, error) {
 	fileName := filepath.Join(dirpath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardFio)
+	return newDataFile(fileName, 0, fio.StandardFio, keys)
 }
 
-// 打开标识 merge 完成文件
+// 打开数据文件对应的 Hint 文件
+func OpenDataHintFile(dirpath string, fileid uint32, keys KeyProvider) (*DataFile, error) {
+	fileName := GetHintFileName(dirpath, fileid)
+	return newDataFile(fileName, fileid, fio.StandardFio, keys)
+}
+
+// 打开标识 merge 完成文件，其中只有文件id，不需要加密
 func OpenMergeFinishedFile(dirpath string) (*DataFile, error) {
 	fileName := filepath.Join(dirpath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardFio)
+	return newDataFile(fileName, 0, fio.StandardFio, nil)
+}
+
+// 打开内存索引的快照文件
+func OpenIndexSnapshotFile(dirpath string, keys KeyProvider) (*DataFile, error) {
+	fileName := filepath.Join(dirpath, IndexSnapshotFileName)
+	return newDataFile(fileName, 0, fio.StandardFio, keys)
 }
 
-// 打开标识 merge 完成文件
-func OpenSeqNoFile(dirpath string) (*DataFile, error) {
+// 打开事务序列号文件
+func OpenSeqNoFile(dirpath string, keys KeyProvider) (*DataFile, error) {
 	fileName := filepath.Join(dirpath, SeqNoFileName)
-	return newDataFile(fileName, 0, fio.StandardFio)
+	return newDataFile(fileName, 0, fio.StandardFio, keys)
+}
+
+// 打开事务序列号的临时文件，写入完成之后替换掉事务序列号文件
+func OpenSeqNoTmpFile(dirpath string, keys KeyProvider) (*DataFile, error) {
+	fileName := filepath.Join(dirpath, SeqNoTmpFileName)
+	return newDataFile(fileName, 0, fio.StandardFio, keys)
 }
 
 func (df *DataFile) Sync() error {
@@ -75,25 +142,99 @@ func (df *DataFile) Close() error {
 	return df.IoManager.Close()
 }
 
+// Ref 增加一个引用，被引用的文件在淘汰之后也不会被关闭
+func (df *DataFile) Ref() {
+	atomic.AddInt32(&df.refs, 1)
+}
+
+// Unref 释放一个引用，已经被淘汰的文件在引用归零后关闭
+func (df *DataFile) Unref() {
+	if atomic.AddInt32(&df.refs, -1) == 0 && atomic.LoadInt32(&df.retired) == 1 {
+		df.closeRetired()
+	}
+}
+
+// Retire 淘汰数据文件，没有引用时立即关闭，否则等到最后一个引用释放时关闭
+func (df *DataFile) Retire() {
+	atomic.StoreInt32(&df.retired, 1)
+	if atomic.LoadInt32(&df.refs) == 0 {
+		df.closeRetired()
+	}
+}
+
+func (df *DataFile) closeRetired() {
+	if atomic.CompareAndSwapInt32(&df.closed, 0, 1) {
+		_ = df.IoManager.Close()
+	}
+}
+
 func (df *DataFile) Write(b []byte) error {
 	n, err := df.IoManager.Write(b)
 	if err != nil {
+		if n > 0 {
+			df.discardPartialWrite(n)
+		}
 		return err
 	}
 	df.Writeoff += int64(n)
 	return nil
 }
 
+// 写入失败时可能已经写入了部分数据，截断掉这部分数据，避免之后写入的数据位置和 Writeoff 不一致
+// 无法截断时跳过这部分数据，加载时会被当作损坏的数据
+func (df *DataFile) discardPartialWrite(n int) {
+	if truncater, ok := df.IoManager.(fio.Truncater); ok {
+		if truncater.Truncate(df.Writeoff) == nil {
+			return
+		}
+	}
+	df.Writeoff += int64(n)
+}
+
 // 写入索引信息到Hint
 func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	record := &LogRecord{
 		Key:   key,
 		Value: Encode_LogRecordPos(pos),
 	}
-	encrecord, _ := Encode_LogRecord(record)
+	encrecord, _ := df.EncodeRecord(record)
+	return df.Write(encrecord)
+}
+
+// WriteHintEntry 写入数据文件 Hint 中的一条记录，保留数据的原始 Key（包含事务序列号）和类型
+func (df *DataFile) WriteHintEntry(key []byte, typ LogRecordType, pos *LogRecordPos) error {
+	record := &LogRecord{
+		Key:   key,
+		Value: Encode_LogRecordPos(pos),
+		Type:  typ,
+	}
+	encrecord, _ := df.EncodeRecord(record)
+	return df.Write(encrecord)
+}
+
+// WriteHintEnd 写入数据文件 Hint 的结束标记，记录生成时数据文件的长度
+// 没有结束标记或者长度和数据文件不一致的 Hint 文件不能使用
+func (df *DataFile) WriteHintEnd(dataSize int64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, dataSize)
+	record := &LogRecord{Value: buf[:n]}
+	encrecord, _ := df.EncodeRecord(record)
 	return df.Write(encrecord)
 }
 
+// DecodeHintEnd 判断 Hint 中的记录是否为结束标记，返回对应数据文件的长度
+// 数据的 Key 中至少包含事务序列号，只有结束标记的 Key 为空
+func DecodeHintEnd(record *LogRecord) (int64, bool) {
+	if len(record.Key) != 0 {
+		return 0, false
+	}
+	dataSize, n := binary.Varint(record.Value)
+	if n <= 0 {
+		return 0, false
+	}
+	return dataSize, true
+}
+
 // ReadRecord 根据offset从数据文件中读取LogRecord并返回字节数
 func (df *DataFile) ReadRecord(offset int64) (*LogRecord, int64, error) {
 	size, err := df.IoManager.Size()
@@ -107,8 +248,8 @@ func (df *DataFile) ReadRecord(offset int64) (*LogRecord, int64, error) {
 		headerBytes = size - offset
 	}
 
-	//读取Header信息【crc type keysize valuesize】
-	headerBuf, err := df.readNBytes(headerBytes, offset)
+	//读取Header信息【crc type keysize valuesize】，只在本方法内使用，内存映射的文件不需要拷贝
+	headerBuf, err := df.peekNBytes(headerBytes, offset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -127,7 +268,12 @@ func (df *DataFile) ReadRecord(offset int64) (*LogRecord, int64, error) {
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
 
-	logRecord := &LogRecord{Type: header.Type}
+	//数据超出了文件末尾，说明写入时被中断或者Header已经损坏
+	if offset+recordSize > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	logRecord := &LogRecord{Type: header.Type, ExpireAt: header.expireAt}
 	//开始读取用户的实际存储的 Key/Value数据
 	if keySize > 0 || valueSize > 0 {
 		kvbuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
@@ -144,9 +290,32 @@ func (df *DataFile) ReadRecord(offset int64) (*LogRecord, int64, error) {
 	if crc != header.crc {
 		return nil, 0, ErrInvalidCrc
 	}
+
+	//校验通过之后先解密再解压 Value
+	if header.encrypted {
+		if err := df.decryptRecord(logRecord, headerBuf[crc32.Size:headerSize]); err != nil {
+			return nil, 0, err
+		}
+	}
+	if header.compression != CompressionNone {
+		value, err := decompressValue(header.compression, logRecord.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		logRecord.Value = value
+		logRecord.Compression = header.compression
+	}
 	return logRecord, recordSize, nil
 }
 
+// peekNBytes 读取N个字节，内存映射的文件直接返回映射区域，不能在返回之后继续持有
+func (df *DataFile) peekNBytes(n int64, offset int64) ([]byte, error) {
+	if zc, ok := df.IoManager.(fio.ZeroCopyReader); ok {
+		return zc.Bytes(n, offset)
+	}
+	return df.readNBytes(n, offset)
+}
+
 // readNBytes 调用IOManager接口，实现从OFFSET读取N个字节
 func (df *DataFile) readNBytes(n int64, offset int64) ([]byte, error) {
 	b := make([]byte, n)
@@ -157,6 +326,41 @@ func (df *DataFile) readNBytes(n int64, offset int64) ([]byte, error) {
 	return b, err
 }
 
+// SetMMapWriter 活跃文件切换为可写的内存映射，从 Writeoff 处继续写入
+func (df *DataFile) SetMMapWriter(dirpath string, capacity int64) error {
+	if _, ok := df.IoManager.(*fio.MMapWriter); ok {
+		return nil
+	}
+	if err := df.IoManager.Close(); err != nil {
+		return err
+	}
+	ioManager, err := fio.NewMMapWriteIOManager(GetDataFileName(dirpath, df.FileId), df.Writeoff, capacity)
+	if err != nil {
+		return err
+	}
+	df.IoManager = ioManager
+	df.readOnly = false
+	return nil
+}
+
+// MemoryMapped 文件是否通过内存映射读取
+func (df *DataFile) MemoryMapped() bool {
+	switch df.IoManager.(type) {
+	case *fio.MMap, *fio.MMapWriter:
+		return true
+	default:
+		return false
+	}
+}
+
+// Seal 文件不再写入，截断可写内存映射预留的空间
+func (df *DataFile) Seal() error {
+	if mw, ok := df.IoManager.(*fio.MMapWriter); ok {
+		return mw.Seal()
+	}
+	return nil
+}
+
 func (df *DataFile) SetIoManager(dirpath string, iotype fio.FileIoType) error {
 	if err := df.IoManager.Close(); err != nil {
 		return err
@@ -166,5 +370,15 @@ func (df *DataFile) SetIoManager(dirpath string, iotype fio.FileIoType) error {
 		return err
 	}
 	df.IoManager = ioManger
+	df.readOnly = iotype == fio.MemoryMap
+
+	//只读打开时没有写入文件头的空文件
+	size, err := ioManger.Size()
+	if err != nil {
+		return err
+	}
+	if df.Header == nil && size == 0 {
+		return df.writeHeader()
+	}
 	return nil
 }
@@ -2,6 +2,7 @@ package data
 
 import (
 	"bitcask/fio"
+	"bytes"
 	"os"
 	"testing"
 
@@ -9,33 +10,34 @@ import (
 )
 
 func TestOpenDataFile(t *testing.T) {
-	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio)
+	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile1)
 
-	datafile2, err := OpenDataFile(os.TempDir(), 1, fio.StandardFio)
+	datafile2, err := OpenDataFile(os.TempDir(), 1, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile2)
 
-	datafile3, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio)
+	datafile3, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile3)
 }
 
 func TestDataFile_Write(t *testing.T) {
-	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio)
+	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile1)
+	offset := datafile1.Writeoff
 	err = datafile1.Write([]byte("aaa"))
 	assert.Nil(t, err)
 	err = datafile1.Write([]byte("aaa"))
 	assert.Nil(t, err)
 
-	assert.Equal(t, datafile1.Writeoff, int64(6))
+	assert.Equal(t, datafile1.Writeoff, offset+6)
 }
 
 func TestDataFile_Close(t *testing.T) {
-	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio)
+	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile1)
 
@@ -44,7 +46,7 @@ func TestDataFile_Close(t *testing.T) {
 }
 
 func TestDataFile_Sync(t *testing.T) {
-	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio)
+	datafile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile1)
 
@@ -53,9 +55,10 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_ReadRecord(t *testing.T) {
-	datafile, err := OpenDataFile(os.TempDir(), 12, fio.StandardFio)
+	datafile, err := OpenDataFile(os.TempDir(), 12, fio.StandardFio, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, datafile)
+	offset := datafile.Writeoff
 
 	//只有一条logrecord
 	rec := &LogRecord{
@@ -67,7 +70,7 @@ func TestDataFile_ReadRecord(t *testing.T) {
 
 	err = datafile.Write(res)
 	assert.Nil(t, err)
-	readres, readsize, err := datafile.ReadRecord(0)
+	readres, readsize, err := datafile.ReadRecord(offset)
 	assert.Nil(t, err)
 	assert.Equal(t, size1, readsize)
 	assert.Equal(t, rec, readres)
@@ -82,7 +85,7 @@ func TestDataFile_ReadRecord(t *testing.T) {
 	err = datafile.Write(res2)
 	assert.Nil(t, err)
 
-	readres, readsize, err = datafile.ReadRecord(size1)
+	readres, readsize, err = datafile.ReadRecord(offset + size1)
 	assert.Nil(t, err)
 	assert.Equal(t, size2, readsize)
 	assert.Equal(t, rec2, readres)
@@ -97,8 +100,107 @@ func TestDataFile_ReadRecord(t *testing.T) {
 	err = datafile.Write(res3)
 	assert.Nil(t, err)
 
-	readres, readsize, err = datafile.ReadRecord(size1 + size2)
+	readres, readsize, err = datafile.ReadRecord(offset + size1 + size2)
 	assert.Nil(t, err)
 	assert.Equal(t, size3, readsize)
 	assert.Equal(t, rec3, readres)
 }
+
+func TestDataFile_Header(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-header")
+	defer os.RemoveAll(dir)
+
+	//新文件写入文件头，数据从文件头之后开始
+	datafile, err := OpenDataFile(dir, 0, fio.StandardFio, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, datafile.Header)
+	assert.Equal(t, FileFormatVersion, datafile.Header.Version)
+	assert.Equal(t, int64(FileHeaderSize), datafile.DataOffset())
+	assert.Equal(t, int64(FileHeaderSize), datafile.Writeoff)
+	assert.Nil(t, datafile.Close())
+
+	datafile, err = OpenDataFile(dir, 0, fio.StandardFio, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, datafile.Header)
+	assert.Nil(t, datafile.Close())
+
+	//旧格式文件没有文件头
+	res, _ := Encode_LogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask")})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), res, 0644))
+	datafile, err = OpenDataFile(dir, 1, fio.StandardFio, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, datafile.Header)
+	assert.Equal(t, int64(0), datafile.DataOffset())
+	record, _, err := datafile.ReadRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask"), record.Value)
+	assert.Nil(t, datafile.Close())
+
+	//更高版本的文件拒绝打开
+	header := EncodeFileHeader(&FileHeader{Version: FileFormatVersion + 1})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 2), header, 0644))
+	_, err = OpenDataFile(dir, 2, fio.StandardFio, nil)
+	assert.Equal(t, ErrUnsupportedFileVersion, err)
+
+	//文件头损坏
+	header = EncodeFileHeader(&FileHeader{Version: FileFormatVersion})
+	header[10] ^= 0xff
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 3), header, 0644))
+	_, err = OpenDataFile(dir, 3, fio.StandardFio, nil)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+
+	//写入文件头时被中断
+	header = EncodeFileHeader(&FileHeader{Version: FileFormatVersion})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 4), header[:10], 0644))
+	datafile, err = OpenDataFile(dir, 4, fio.StandardFio, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, datafile.Header)
+	size, _ := datafile.IoManager.Size()
+	assert.Equal(t, int64(FileHeaderSize), size)
+	assert.Nil(t, datafile.Close())
+}
+
+type testKeyProvider map[uint32][]byte
+
+func (p testKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return 1, p[1], nil
+}
+
+func (p testKeyProvider) Key(id uint32) ([]byte, error) {
+	return p[id], nil
+}
+
+func TestDataFile_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encrypt")
+	defer os.RemoveAll(dir)
+	keys := testKeyProvider{1: []byte("0123456789abcdef")}
+
+	datafile, err := OpenDataFile(dir, 0, fio.StandardFio, keys)
+	assert.Nil(t, err)
+	assert.True(t, datafile.Encrypted())
+	assert.Equal(t, FileFlagEncrypted, datafile.Header.Flags&FileFlagEncrypted)
+
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go"), Type: LogRecordDeleted, ExpireAt: 100}
+	res, size := datafile.EncodeRecord(rec)
+	assert.False(t, bytes.Contains(res, rec.Key))
+	assert.False(t, bytes.Contains(res, rec.Value))
+	offset := datafile.Writeoff
+	assert.Nil(t, datafile.Write(res))
+	readres, readsize, err := datafile.ReadRecord(offset)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readsize)
+	assert.Equal(t, rec.Key, readres.Key)
+	assert.Equal(t, rec.Value, readres.Value)
+	assert.Equal(t, rec.Type, readres.Type)
+	assert.Equal(t, rec.ExpireAt, readres.ExpireAt)
+	assert.Nil(t, datafile.Close())
+
+	//没有密钥时无法打开，密钥错误时无法读取
+	_, err = OpenDataFile(dir, 0, fio.StandardFio, nil)
+	assert.Equal(t, ErrEncryptionKeyRequired, err)
+	datafile, err = OpenDataFile(dir, 0, fio.StandardFio, testKeyProvider{1: []byte("fedcba9876543210")})
+	assert.Nil(t, err)
+	_, _, err = datafile.ReadRecord(offset)
+	assert.Equal(t, ErrDecryptFailed, err)
+	assert.Nil(t, datafile.Close())
+}
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrEncryptionKeyRequired = errors.New("data file is encrypted but no encryption key is provided")
+	ErrDecryptFailed         = errors.New("failed to decrypt log record,key is wrong or data is corrupted")
+)
+
+// KeyProvider 提供加密数据文件使用的密钥，密钥长度为 16、24 或 32 字节，对应 AES-128/192/256
+// 每个文件使用创建时的当前密钥，密钥id记录在文件头中
+type KeyProvider interface {
+	//CurrentKey 返回创建新文件时使用的密钥及其id
+	CurrentKey() (uint32, []byte, error)
+
+	//Key 根据密钥id返回读取旧文件所需的密钥
+	Key(id uint32) ([]byte, error)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted 文件是否经过加密
+func (df *DataFile) Encrypted() bool {
+	return df.aead != nil
+}
+
+// KeyId 返回加密文件使用的密钥id
+func (df *DataFile) KeyId() uint32 {
+	if df.Header == nil {
+		return 0
+	}
+	return df.Header.KeyId
+}
+
+// KeyMatches 判断文件的加密方式是否和 keys 当前的密钥一致
+func (df *DataFile) KeyMatches(keys KeyProvider) (bool, error) {
+	if keys == nil {
+		return !df.Encrypted(), nil
+	}
+	id, _, err := keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	return df.Encrypted() && df.Header.KeyId == id, nil
+}
+
+// EncodeRecord 按照文件的加密方式编码 LogRecord，写入该文件的数据都需要通过此方法编码
+func (df *DataFile) EncodeRecord(logrecord *LogRecord) ([]byte, int64) {
+	return encodeLogRecord(logrecord, df.aead)
+}
+
+// 根据文件头加载密钥
+func (df *DataFile) loadCipher(header *FileHeader) error {
+	if header.Flags&FileFlagEncrypted == 0 {
+		return nil
+	}
+	if df.keys == nil {
+		return ErrEncryptionKeyRequired
+	}
+	key, err := df.keys.Key(header.KeyId)
+	if err != nil {
+		return err
+	}
+	df.aead, err = newAEAD(key)
+	return err
+}
+
+// 解密 Value 部分，还原出 Key 和 Value
+func (df *DataFile) decryptRecord(logRecord *LogRecord, headerBuf []byte) error {
+	if df.aead == nil {
+		return ErrEncryptionKeyRequired
+	}
+	nonceSize := df.aead.NonceSize()
+	if len(logRecord.Value) < nonceSize {
+		return ErrDecryptFailed
+	}
+	nonce, sealed := logRecord.Value[:nonceSize], logRecord.Value[nonceSize:]
+	plaintext, err := df.aead.Open(nil, nonce, sealed, headerBuf)
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	keySize, n := binary.Uvarint(plaintext)
+	if n <= 0 || uint64(len(plaintext)-n) < keySize {
+		return ErrDecryptFailed
+	}
+	logRecord.Key = plaintext[n : n+int(keySize)]
+	logRecord.Value = plaintext[n+int(keySize):]
+	return nil
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"time"
+)
+
+/*
+	文件头，位于数据文件、Hint文件和事务序列号文件的开头
+	+-------------+-------------+-------------+--------------+-------------+-------------+
+	|  magic (4)  | version (2) |  flags (2)  | createAt (8) |  keyId (4)  |   crc (4)   |
+	+-------------+-------------+-------------+--------------+-------------+-------------+
+	没有文件头的旧格式文件直接以 LogRecord 开始，读取时从 0 开始
+*/
+
+const (
+	FileHeaderSize = 24
+
+	// FileFormatVersion 当前的文件格式版本，LogRecord 的编码格式变化时需要递增
+	// 1: 加入文件头
+	// 2: LogRecord 的 Type 字节中加入压缩算法标志位
+	// 3: 支持加密文件
+	FileFormatVersion uint16 = 3
+)
+
+const (
+	//FileFlagEncrypted 文件中的所有数据都经过加密，keyId 为使用的密钥
+	FileFlagEncrypted uint16 = 1 << iota
+
+	knownFileFlags = FileFlagEncrypted
+)
+
+var fileMagic = []byte("BCKV")
+
+var (
+	ErrInvalidFileHeader      = errors.New("invalid file header,data file may be corrupted")
+	ErrUnsupportedFileVersion = errors.New("unsupported data file format version")
+)
+
+// FileHeader 文件头
+type FileHeader struct {
+	Version  uint16 //文件格式版本
+	Flags    uint16 //文件特性标识
+	CreateAt int64  //文件创建时间，纳秒
+	KeyId    uint32 //加密文件使用的密钥id
+}
+
+func newFileHeader() *FileHeader {
+	return &FileHeader{Version: FileFormatVersion, CreateAt: time.Now().UnixNano()}
+}
+
+// EncodeFileHeader 对文件头进行编码
+func EncodeFileHeader(header *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf[:4], fileMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], header.Version)
+	binary.LittleEndian.PutUint16(buf[6:8], header.Flags)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(header.CreateAt))
+	binary.LittleEndian.PutUint32(buf[16:20], header.KeyId)
+	binary.LittleEndian.PutUint32(buf[20:], crc32.ChecksumIEEE(buf[:20]))
+	return buf
+}
+
+// DecodeFileHeader 解码并校验文件头，高于当前版本的文件无法读取
+func DecodeFileHeader(buf []byte) (*FileHeader, error) {
+	if len(buf) < FileHeaderSize || !bytes.Equal(buf[:4], fileMagic) {
+		return nil, ErrInvalidFileHeader
+	}
+	if crc32.ChecksumIEEE(buf[:20]) != binary.LittleEndian.Uint32(buf[20:FileHeaderSize]) {
+		return nil, ErrInvalidFileHeader
+	}
+	header := &FileHeader{
+		Version:  binary.LittleEndian.Uint16(buf[4:6]),
+		Flags:    binary.LittleEndian.Uint16(buf[6:8]),
+		CreateAt: int64(binary.LittleEndian.Uint64(buf[8:16])),
+		KeyId:    binary.LittleEndian.Uint32(buf[16:20]),
+	}
+	//不认识的标识说明文件由更高版本写入
+	if header.Version == 0 || header.Version > FileFormatVersion || header.Flags&^knownFileFlags != 0 {
+		return nil, ErrUnsupportedFileVersion
+	}
+	return header, nil
+}
+
+// 读取并校验文件头，空文件写入新的文件头
+// 开头不是 magic 的文件是旧格式文件，Header 为 nil
+func (df *DataFile) loadHeader(fileName string) error {
+	size, err := df.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		if df.inspect {
+			return nil
+		}
+		return df.writeHeader()
+	}
+
+	buf, err := df.readNBytes(min(size, FileHeaderSize), 0)
+	if err != nil {
+		return err
+	}
+	magicLen := min(len(buf), len(fileMagic))
+	if !bytes.Equal(buf[:magicLen], fileMagic[:magicLen]) {
+		return nil
+	}
+
+	//写入文件头时被中断，文件中还没有数据，重新写入文件头
+	if size < FileHeaderSize {
+		if df.inspect {
+			return ErrInvalidFileHeader
+		}
+		if err := os.Truncate(fileName, 0); err != nil {
+			return err
+		}
+		return df.writeHeader()
+	}
+
+	header, err := DecodeFileHeader(buf)
+	if err != nil {
+		return err
+	}
+	if err := df.loadCipher(header); err != nil {
+		return err
+	}
+	df.Header = header
+	return nil
+}
+
+// 向空文件写入文件头，内存映射打开的文件无法写入，切换为标准文件 Io 后再写入
+// 提供了密钥时使用当前密钥加密新文件
+func (df *DataFile) writeHeader() error {
+	if df.readOnly {
+		return nil
+	}
+	header := newFileHeader()
+	if df.keys != nil {
+		id, key, err := df.keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		if df.aead, err = newAEAD(key); err != nil {
+			return err
+		}
+		header.Flags |= FileFlagEncrypted
+		header.KeyId = id
+	}
+	if err := df.Write(EncodeFileHeader(header)); err != nil {
+		return err
+	}
+	df.Header = header
+	return nil
+}
+
+// DataOffset 返回文件中第一条 LogRecord 的位置
+func (df *DataFile) DataOffset() int64 {
+	if df.Header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
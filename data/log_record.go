@@ -1,6 +1,8 @@
 package data
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"hash/crc32"
 )
@@ -13,22 +15,41 @@ const (
 	LogRecordTxnFinished
 )
 
-// crc type keysize valuesize
-// 4   1     5				5     =15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// Type 字节的高位用作标志位，低位才是真正的 LogRecordType
+const (
+	//标识 header 中带有过期时间
+	logRecordExpireFlag byte = 0x80
+
+	//Value 的压缩算法，为 0 表示没有压缩
+	logRecordCompressMask  byte = 0x30
+	logRecordCompressShift      = 4
+
+	//Key 和 Value 经过加密，加密后的数据全部存放在 Value 部分
+	logRecordEncryptFlag byte = 0x40
+
+	logRecordTypeMask byte = 0x0f
+)
+
+// crc type keysize valuesize expireAt
+// 4   1     5				5					10     =25
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 
 // 数据内存索引，描述数据在磁盘的位置
 type LogRecordPos struct {
-	Fid    uint32 //文件id,表示将数据存到了哪个文件
-	Offset int64  //偏移，存储到了文件中的哪个位置
-	Size   uint32 //标识数据大小
+	Fid      uint32 //文件id,表示将数据存到了哪个文件
+	Offset   int64  //偏移，存储到了文件中的哪个位置
+	Size     uint32 //标识数据大小
+	ExpireAt int64  //过期时间(UnixNano)，0表示永不过期
 }
 
 // 写入到数据文件的Entry
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType //标记Entry是否被替代
+	Key      []byte
+	Value    []byte
+	Type     LogRecordType //标记Entry是否被替代
+	ExpireAt int64         //过期时间(UnixNano)，0表示永不过期
+
+	Compression CompressionType //Value 的压缩算法，编码时压缩，读取时已经解压
 }
 
 // LogRecordHeader Entry头部字段
@@ -37,6 +58,15 @@ type LogRecordHeader struct {
 	Type      LogRecordType //标识LogRecord类型
 	keySize   uint32        //key长度
 	valueSize uint32        //value长度
+	expireAt  int64         //过期时间，仅当带有过期标志位时存在
+
+	compression CompressionType //Value 的压缩算法
+	encrypted   bool            //Key 和 Value 是否经过加密
+}
+
+// Expired 判断位置信息对应的数据在 now 时刻是否已经过期
+func (pos *LogRecordPos) Expired(now int64) bool {
+	return pos.ExpireAt > 0 && pos.ExpireAt <= now
 }
 
 // 暂存事务结构
@@ -48,11 +78,15 @@ type TransactionRecords struct {
 
 // 对位置信息进行编码
 func Encode_LogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	//没有过期时间的位置信息保持旧格式
+	if pos.ExpireAt > 0 {
+		index += binary.PutVarint(buf[index:], pos.ExpireAt)
+	}
 
 	return buf[:index]
 }
@@ -64,39 +98,85 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
+	size, n := binary.Varint(buf[index:])
+	index += n
+	var expireAt int64
+	if index < len(buf) {
+		expireAt, _ = binary.Varint(buf[index:])
+	}
 	return &LogRecordPos{
-		Fid:    uint32(fileId),
-		Offset: offset,
-		Size:   uint32(size),
+		Fid:      uint32(fileId),
+		Offset:   offset,
+		Size:     uint32(size),
+		ExpireAt: expireAt,
 	}
 }
 
 // 对LogRecord进行编码，返回字节数组和长度
 func Encode_LogRecord(logrecord *LogRecord) ([]byte, int64) {
-	/*-------------------------------------------------------------
-	| crc   type    keysize      valuesize  |   key       value		|
-	|	4			1			变长(最大5)		变长(最大5)	 | keysize		valuesize|
-	------------------------------------------------------------*/
+	return encodeLogRecord(logrecord, nil)
+}
+
+// 编码 LogRecord，aead 不为空时先压缩再加密
+func encodeLogRecord(logrecord *LogRecord, aead cipher.AEAD) ([]byte, int64) {
+	/*-------------------------------------------------------------------------------
+	| crc   type    keysize      valuesize    expireAt   |   key       value		|
+	|	4			1			变长(最大5)		变长(最大5)	 变长(最大10) | keysize		valuesize|
+	-------------------------------------------------------------------------------*/
 
 	//初始化一个header部分的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 
-	//第5个字节储存Type
+	//第5个字节储存Type，带过期时间的记录打上标志位
 	header[4] = logrecord.Type
+	if logrecord.ExpireAt > 0 {
+		header[4] |= logRecordExpireFlag
+	}
+	//压缩之后没有变小的 Value 直接保存原始数据
+	value, compressed := compressValue(logrecord.Compression, logrecord.Value)
+	if compressed {
+		header[4] |= logrecord.Compression << logRecordCompressShift
+	}
+	key := logrecord.Key
+	if aead != nil {
+		header[4] |= logRecordEncryptFlag
+	}
 	var index = 5
 
-	//5字节后，写入size信息
-	index += binary.PutVarint(header[index:], int64(len(logrecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logrecord.Value)))
+	//加密之后 Key 为空，Value 为 nonce+密文
+	var plaintext []byte
+	if aead != nil {
+		plaintext = make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+len(key)+len(value))
+		plaintext = append(plaintext[:binary.PutUvarint(plaintext, uint64(len(key)))], key...)
+		plaintext = append(plaintext, value...)
+		key, value = nil, nil
+		index += binary.PutVarint(header[index:], 0)
+		index += binary.PutVarint(header[index:], int64(aead.NonceSize()+len(plaintext)+aead.Overhead()))
+	} else {
+		//5字节后，写入size信息
+		index += binary.PutVarint(header[index:], int64(len(key)))
+		index += binary.PutVarint(header[index:], int64(len(value)))
+	}
 
-	var realsize = index + len(logrecord.Key) + len(logrecord.Value)
+	//只有设置了过期时间才写入 expireAt，保证旧记录格式不变
+	if logrecord.ExpireAt > 0 {
+		index += binary.PutVarint(header[index:], logrecord.ExpireAt)
+	}
+
+	//header 作为附加数据参与认证，防止类型和过期时间被篡改
+	if aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		_, _ = rand.Read(nonce)
+		value = aead.Seal(nonce, nonce, plaintext, header[4:index])
+	}
+
+	var realsize = index + len(key) + len(value)
 	EncodeBytes := make([]byte, realsize)
 
 	//将header切片拷贝过来
 	copy(EncodeBytes, header[:index])
-	copy(EncodeBytes[index:], logrecord.Key)
-	copy(EncodeBytes[index+len(logrecord.Key):], logrecord.Value)
+	copy(EncodeBytes[index:], key)
+	copy(EncodeBytes[index+len(key):], value)
 
 	//crc校验
 	crc := crc32.ChecksumIEEE(EncodeBytes[4:])
@@ -113,7 +193,10 @@ func decodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 
 	header := &LogRecordHeader{
 		crc:  binary.LittleEndian.Uint32(buf[:4]),
-		Type: buf[4],
+		Type: buf[4] & logRecordTypeMask,
+
+		compression: (buf[4] & logRecordCompressMask) >> logRecordCompressShift,
+		encrypted:   buf[4]&logRecordEncryptFlag != 0,
 	}
 
 	var index = 5
@@ -127,6 +210,13 @@ func decodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	header.valueSize = uint32(valuesize)
 	index += n
 
+	//取出过期时间
+	if buf[4]&logRecordExpireFlag != 0 {
+		expireAt, n := binary.Varint(buf[index:])
+		header.expireAt = expireAt
+		index += n
+	}
+
 	return header, int64(index)
 }
 
@@ -1,7 +1,11 @@
 package data
 
 import (
+	"bitcask/fio"
+	"bytes"
+	"crypto/rand"
 	"hash/crc32"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -90,3 +94,93 @@ func TestGetLogRecordCrc(t *testing.T) {
 	assert.Equal(t, crc, uint32(240712713))
 
 }
+
+func TestEncodeLogRecordWithExpire(t *testing.T) {
+	rec := &LogRecord{
+		Key:      []byte("name"),
+		Value:    []byte("bitcask-go"),
+		Type:     LogRecordNormal,
+		ExpireAt: 1700000000000000000,
+	}
+	res, n := Encode_LogRecord(rec)
+	assert.NotNil(t, res)
+
+	header, size := decodeLogRecordHeader(res)
+	assert.Equal(t, LogRecordNormal, header.Type)
+	assert.Equal(t, rec.ExpireAt, header.expireAt)
+	assert.Equal(t, n, size+int64(header.keySize)+int64(header.valueSize))
+
+	crc := getLogRecordCrc(rec, res[crc32.Size:size])
+	assert.Equal(t, header.crc, crc)
+
+	//位置信息编码后也要保留过期时间
+	pos := &LogRecordPos{Fid: 1, Offset: 100, Size: 20, ExpireAt: rec.ExpireAt}
+	assert.Equal(t, pos, DecodeLogRecordPos(Encode_LogRecordPos(pos)))
+	pos.ExpireAt = 0
+	assert.Equal(t, pos, DecodeLogRecordPos(Encode_LogRecordPos(pos)))
+}
+
+func TestEncodeLogRecordWithCompression(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-compress")
+	defer os.RemoveAll(dir)
+	datafile, err := OpenDataFile(dir, 0, fio.StandardFio, nil)
+	assert.Nil(t, err)
+	defer datafile.Close()
+
+	value := bytes.Repeat([]byte(`{"name":"bitcask","type":"kv","tags":["go","storage"]},`), 40)
+	for _, tp := range []CompressionType{CompressionNone, CompressionSnappy, CompressionDeflate, CompressionZstd} {
+		rec := &LogRecord{Key: []byte("name"), Value: value, Compression: tp}
+		res, size := Encode_LogRecord(rec)
+		if tp == CompressionNone {
+			assert.Greater(t, size, int64(len(value)))
+		} else {
+			assert.Less(t, size*5, int64(len(value)))
+		}
+
+		//读取时校验之后解压
+		offset := datafile.Writeoff
+		assert.Nil(t, datafile.Write(res))
+		readres, readsize, err := datafile.ReadRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, size, readsize)
+		assert.Equal(t, value, readres.Value)
+		assert.Equal(t, tp, readres.Compression)
+	}
+
+	//无法压缩的数据保存原始内容
+	random := make([]byte, 256)
+	_, _ = rand.Read(random)
+	res, size := Encode_LogRecord(&LogRecord{Key: []byte("name"), Value: random, Compression: CompressionSnappy})
+	assert.Greater(t, size, int64(len(random)))
+	header, _ := decodeLogRecordHeader(res)
+	assert.Equal(t, CompressionNone, header.compression)
+}
+
+func TestSnappyEncode(t *testing.T) {
+	inputs := [][]byte{
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("0123456789"), 10000),
+	}
+	random := make([]byte, 100000)
+	_, _ = rand.Read(random)
+	inputs = append(inputs, append(random[:5000:5000], random[:5000]...))
+
+	for _, input := range inputs {
+		compressed, ok := compressValue(CompressionSnappy, input)
+		assert.True(t, ok)
+		decoded, err := decompressValue(CompressionSnappy, compressed)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(input, decoded))
+	}
+
+	//之前写入的 Snappy 块格式数据仍然可以解压
+	encoded := []byte{0x58, 0x44, 0x62, 0x69, 0x74, 0x63, 0x61, 0x73, 0x6b, 0x2d, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35,
+		0x36, 0x37, 0x38, 0x39, 0xee, 0xa, 0x0, 0x19, 0xa}
+	decoded, err := decompressValue(CompressionSnappy, encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte("bitcask-"), bytes.Repeat([]byte("0123456789"), 8)...), decoded)
+
+	//损坏的数据
+	_, err = decompressValue(CompressionSnappy, encoded[:len(encoded)-1])
+	assert.NotNil(t, err)
+}
@@ -5,15 +5,16 @@ import (
 	"bitcask/fio"
 	"bitcask/index"
 	"bitcask/utils"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/flock"
 )
@@ -33,19 +34,34 @@ const (
 )
 
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     //文件id,只能在加载索引的使用，递增
-	activefile      *data.DataFile            //当前活跃文件，用于读写
-	olderfile       map[uint32]*data.DataFile //旧文件，只能用于读
-	index           index.Indexer             //内存索引接口
-	seqNo           int64                     //事务序列号，全局递增
-	isMerging       bool                      //是否正在Merge
-	seqNoFileExists bool                      //存储事务序列号的文件是否存在
-	isInitial       bool                      //是否是第一次初始化此数据目录
-	fileLock        *flock.Flock              //文件锁保障多进程之间互斥
-	bytesWrite      uint                      //累计写了多少个字节
-	DeletedSize     int64                     //无效数据
+	options             Options
+	mu                  *sync.RWMutex
+	fileIds             []int                     //文件id,只能在加载索引的使用，递增
+	activefile          *data.DataFile            //当前活跃文件，用于读写
+	olderfile           map[uint32]*data.DataFile //旧文件，只能用于读
+	index               index.Indexer             //内存索引接口
+	seqNo               int64                     //事务序列号，全局递增
+	isMerging           bool                      //是否正在Merge
+	seqNoFileExists     bool                      //存储事务序列号的文件是否存在
+	isInitial           bool                      //是否是第一次初始化此数据目录
+	fileLock            *flock.Flock              //文件锁保障多进程之间互斥
+	bytesWrite          uint                      //累计写了多少个字节
+	DeletedSize         int64                     //无效数据
+	activeTxns          map[*Txn]struct{}         //正在进行中的乐观事务
+	recentWrites        map[string]int64          //存在活跃事务期间被修改的key及其序列号
+	copyingSnaps        map[*Snapshot]struct{}    //正在拷贝索引的快照
+	commitMu            *sync.Mutex               //保护组提交队列
+	commitQueue         []*commitRequest          //等待组提交的写请求
+	commitToken         chan struct{}             //持有者为当前组提交的写入者
+	mergeCancel         context.CancelFunc        //通知后台自动 Merge 协程退出
+	mergeWg             *sync.WaitGroup           //等待后台自动 Merge 协程退出
+	hintWg              *sync.WaitGroup           //等待后台生成 Hint 文件的协程退出
+	indexSnapshotMu     *sync.Mutex               //保证同一时间只有一个索引快照在写入，Merge 时不写入
+	indexSnapshotCancel context.CancelFunc        //通知后台保存索引快照的协程退出
+	indexSnapshotWg     *sync.WaitGroup           //等待后台保存索引快照的协程退出
+	lastAutoMerge       MergeResult               //最近一次自动 Merge 的结果
+	autoMergeRuns       uint                      //自动 Merge 执行的次数
+	recovery            RecoveryReport            //启动时的数据恢复结果
 }
 
 // 存储引擎统计信息
@@ -54,10 +70,27 @@ type Stat struct {
 	DataFileNum uint  //数据文件数量
 	DeletedSize int64 //无效数据，以字节为单位
 	DiskSize    int64 //占据磁盘空间大小
+
+	AutoMergeRuns uint        //自动 Merge 执行的次数
+	LastAutoMerge MergeResult //最近一次自动 Merge 的结果
+
+	Files []FileStat //每个数据文件的有效和无效数据，按文件id从小到大排序
+
+	ShardKeys []int   //ART 和 HashMap 索引每个分片中的key数量，其他索引为空
+	ShardSkew float64 //key最多的分片和平均值的比值，1 表示完全均匀
+}
+
+// 数据文件统计信息
+type FileStat struct {
+	FileId    uint32
+	LiveSize  int64  //有效数据，以字节为单位
+	DeadSize  int64  //无效数据，以字节为单位
+	Encrypted bool   //是否加密
+	KeyId     uint32 //加密使用的密钥id
 }
 
 // Open 启动 bitcask 存储引擎实例 :检查、安装
-func Open(options Options) (*DB, error) {
+func Open(options Options) (db *DB, err error) {
 	//对用户传入的配置项进行检查
 	if err := checkoptions(options); err != nil {
 		return nil, err
@@ -80,6 +113,12 @@ func Open(options Options) (*DB, error) {
 	if !hold {
 		return nil, ErrDataBaseIsUsing
 	}
+	//启动失败时释放文件锁，否则同一进程无法再次打开
+	defer func() {
+		if err != nil {
+			_ = fileLock.Unlock()
+		}
+	}()
 	entries, err := os.ReadDir(options.Dirpath)
 	if err != nil {
 		return nil, err
@@ -89,13 +128,20 @@ func Open(options Options) (*DB, error) {
 	}
 
 	//初始化DB实例的结构体
-	db := &DB{
-		options:   options,
-		mu:        new(sync.RWMutex),
-		olderfile: make(map[uint32]*data.DataFile),
-		index:     index.NEWIndexer(options.IndexType, options.Dirpath, options.SyncWrites, options.IndexNum),
-		isInitial: isInitial,
-		fileLock:  fileLock,
+	db = &DB{
+		options:         options,
+		mu:              new(sync.RWMutex),
+		olderfile:       make(map[uint32]*data.DataFile),
+		activeTxns:      make(map[*Txn]struct{}),
+		recentWrites:    make(map[string]int64),
+		copyingSnaps:    make(map[*Snapshot]struct{}),
+		commitMu:        new(sync.Mutex),
+		commitToken:     make(chan struct{}, 1),
+		hintWg:          new(sync.WaitGroup),
+		indexSnapshotMu: new(sync.Mutex),
+		index:           newIndexer(options),
+		isInitial:       isInitial,
+		fileLock:        fileLock,
 	}
 
 	//加载 merge 数据
@@ -107,15 +153,25 @@ func Open(options Options) (*DB, error) {
 	if err := db.loadDataFiles(); err != nil {
 		return nil, err
 	}
+	if err := db.removeOrphanHintFiles(); err != nil {
+		return nil, err
+	}
 
 	if options.IndexType != BPlusTree {
-		//从Hint文件加载索引
-		if err := db.loadIndexFromHintFile(); err != nil {
+		//优先从索引快照加载，快照之后写入的数据从数据文件中重放
+		snapshot, err := db.loadIndexSnapshot()
+		if err != nil {
 			return nil, err
 		}
+		if snapshot == nil {
+			//从Hint文件加载索引
+			if err := db.loadIndexFromHintFile(); err != nil {
+				return nil, err
+			}
+		}
 
 		//从数据文件中加载索引
-		if err := db.loadIndexFromDataFiles(); err != nil {
+		if err := db.loadIndexFromDataFiles(snapshot); err != nil {
 			return nil, err
 		}
 		//重置 IO类型为标准文件 Io
@@ -141,11 +197,57 @@ func Open(options Options) (*DB, error) {
 		}
 	}
 
+	//活跃文件的加密方式和当前密钥不一致时，之后的数据写入新的文件
+	if err := db.rotateActiveFileForKey(); err != nil {
+		return nil, err
+	}
+	//旧文件使用内存映射读取
+	if options.MMapSealedFiles {
+		for _, dataFile := range db.olderfile {
+			if err := db.mapSealedFile(dataFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	//活跃文件使用可写的内存映射
+	if options.MMapWrite && db.activefile != nil {
+		if err := db.activefile.SetMMapWriter(options.Dirpath, options.DataFileSize); err != nil {
+			return nil, err
+		}
+	}
+
+	//没有 Hint 文件的旧文件在后台生成，下次启动时不需要再扫描
+	if options.IndexType != BPlusTree {
+		for _, dataFile := range db.olderfile {
+			if _, err := os.Stat(data.GetHintFileName(options.Dirpath, dataFile.FileId)); os.IsNotExist(err) {
+				db.writeHintFileAsync(dataFile)
+			}
+		}
+	}
+
+	//启动后台自动 Merge
+	db.startAutoMerge()
+	//启动后台定期保存索引快照
+	db.startIndexSnapshot()
+
 	return db, nil
 }
 
 // 写入 KEY/VALUE 数据总体方法
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+// PutWithTTL 写入带有过期时间的 KEY/VALUE 数据，ttl 为 0 表示永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	var expireAt int64 = 0
+	if ttl != 0 {
+		expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	return db.put(key, value, expireAt)
+}
+
+func (db *DB) put(key []byte, value []byte, expireAt int64) error {
 	//如果 key 无效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
@@ -153,27 +255,22 @@ func (db *DB) Put(key []byte, value []byte) error {
 
 	//构造logRecord 结构体
 	log_record := data.LogRecord{
-		Key:   LogRecordKeyWithSeq(key, NonTransactionSewNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
-	}
+		Key:      LogRecordKeyWithSeq(key, NonTransactionSewNo),
+		Value:    value,
+		Type:     data.LogRecordNormal,
+		ExpireAt: expireAt,
 
-	//追加写入到活跃文件
-	db.mu.Lock()
-	pos, err := db.appendLogRecord(&log_record)
-	db.mu.Unlock()
-	if err != nil {
-		return err
+		Compression: db.options.Compression,
 	}
 
-	//更新内存索引
-	oldpos := db.index.Put(key, pos)
-	if oldpos != nil {
-		db.mu.Lock()
-		db.DeletedSize += int64(oldpos.Size)
-		db.mu.Unlock()
-	}
-	return nil
+	//追加写入到活跃文件，并更新内存索引
+	return db.appendLogRecordWithLock(key, &log_record, func(pos *data.LogRecordPos) {
+		db.saveSnapshotPosLocked(key)
+		if oldpos := db.index.Put(key, pos); oldpos != nil {
+			db.addDeletedSize(oldpos)
+		}
+		db.trackWriteLocked(key)
+	})
 }
 
 // Delete 根据Key 删除对应的数据
@@ -194,25 +291,24 @@ func (db *DB) Delete(key []byte) error {
 		Key:  LogRecordKeyWithSeq(key, NonTransactionSewNo),
 		Type: data.LogRecordDeleted,
 	}
-	db.mu.Lock()
-	pos, err := db.appendLogRecord(&logRecord)
+	var ok bool
+	err := db.appendLogRecordWithLock(key, &logRecord, func(pos *data.LogRecordPos) {
+		//从内存索引中将对应的key删除
+		var oldval *data.LogRecordPos
+		db.saveSnapshotPosLocked(key)
+		oldval, ok = db.index.Delete(key)
+		db.addDeletedSize(pos)
+		if oldval != nil {
+			db.addDeletedSize(oldval)
+		}
+		db.trackWriteLocked(key)
+	})
 	if err != nil {
-		db.mu.Unlock()
-		return nil
+		return err
 	}
-	db.DeletedSize += int64(pos.Size)
-	db.mu.Unlock()
-
-	//从内存索引中将对应的key删除
-	oldval, ok := db.index.Delete(key)
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
-	if oldval != nil {
-		db.mu.Lock()
-		db.DeletedSize += int64(oldval.Size)
-		db.mu.Unlock()
-	}
 	return nil
 }
 
@@ -224,15 +320,22 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	}
 
 	//从内存索引数据结构中取出key对应的索引信息
+	//查找索引和数据文件时持有读锁，保证不会和 Merge 替换数据文件交错
+	db.mu.RLock()
 	logpos := db.index.Get(key)
-	if logpos == nil {
+	if logpos == nil || logpos.Expired(time.Now().UnixNano()) {
+		db.mu.RUnlock()
 		return nil, ErrKeyNotFind
 	}
+	dataFile := db.refDataFile(logpos.Fid)
+	db.mu.RUnlock()
+
 	// 根据索引协议获取对应的Value
-	db.mu.Lock()
-	ans, err := db.getValueByPostion(logpos)
-	db.mu.Unlock()
-	return ans, err
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	defer dataFile.Unref()
+	return readValueFromFile(dataFile, logpos)
 }
 
 // 获取 数据库中所有的key
@@ -240,23 +343,23 @@ func (db *DB) ListKeys() [][]byte {
 	db.mu.RLock()
 	iter := db.index.Iterator(false)
 	defer iter.Close()
-	ans := make([][]byte, db.index.Size())
+	ans := make([][]byte, 0, db.index.Size())
 	db.mu.RUnlock()
-	idx := 0
+	now := time.Now().UnixNano()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		key := iter.Key()
-		ans[idx] = key
-		idx++
+		//跳过已经过期的key
+		if iter.Value().Expired(now) {
+			continue
+		}
+		ans = append(ans, iter.Key())
 	}
 	return ans
 }
 
 // 获取 所有的数据，并执行用户指定的操作
 func (db *DB) Fold(f func(key []byte, value []byte) bool) error {
-	db.mu.RLock()
 	iter := db.NewIterator(DefalutIteratorOptions)
 	defer iter.Close()
-	db.mu.RUnlock()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		key := iter.Key()
 		value, err := iter.Value()
@@ -272,6 +375,18 @@ func (db *DB) Fold(f func(key []byte, value []byte) bool) error {
 
 // 关闭数据库
 func (db *DB) Close() error {
+	//先停止后台自动 Merge，避免和关闭文件并发
+	db.stopAutoMerge()
+	db.hintWg.Wait()
+	db.stopIndexSnapshot()
+
+	//保存索引快照，下次启动时只需要加载快照之后写入的数据
+	if db.options.IndexSnapshot && db.options.IndexType != BPlusTree && db.activefile != nil {
+		if err := db.writeIndexSnapshot(); err != nil {
+			_ = db.fileLock.Unlock()
+			return err
+		}
+	}
 
 	defer func() {
 		if err := db.fileLock.Unlock(); err != nil {
@@ -287,8 +402,13 @@ func (db *DB) Close() error {
 
 	db.index.Close()
 
-	//保存当前事务的序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.options.Dirpath)
+	//保存当前事务的序列号，旧文件可能使用了已经轮换掉的密钥，所以写入新的文件
+	//先写入临时文件并持久化，再替换掉旧的文件，任何时候崩溃都至少保留一个完整的序列号文件
+	tmpFileName := filepath.Join(db.options.Dirpath, data.SeqNoTmpFileName)
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	seqNoFile, err := data.OpenSeqNoTmpFile(db.options.Dirpath, db.options.EncryptionKeys)
 	if err != nil {
 		return err
 	}
@@ -298,12 +418,23 @@ func (db *DB) Close() error {
 		Value: []byte(strconv.FormatUint(uint64(db.seqNo), 10)),
 	}
 
-	encRecord, _ := data.Encode_LogRecord(record)
+	encRecord, _ := seqNoFile.EncodeRecord(record)
 	if err := seqNoFile.Write(encRecord); err != nil {
+		_ = seqNoFile.Close()
 		return err
 	}
-
 	if err := seqNoFile.Sync(); err != nil {
+		_ = seqNoFile.Close()
+		return err
+	}
+	if err := seqNoFile.Close(); err != nil {
+		return err
+	}
+	seqNoFileName := filepath.Join(db.options.Dirpath, data.SeqNoFileName)
+	if err := os.Rename(tmpFileName, seqNoFileName); err != nil {
+		return err
+	}
+	if err := utils.SyncDir(db.options.Dirpath); err != nil {
 		return err
 	}
 
@@ -330,16 +461,69 @@ func (db *DB) Sync() error {
 }
 
 // 根据索引协议获取对应的Value
+// 只在查找数据文件时持有读锁，读取期间通过引用计数防止文件被 Merge 关闭
 func (db *DB) getValueByPostion(logpos *data.LogRecordPos) ([]byte, error) {
-	//根据文件ID找到数据文件
-	var dataFile *data.DataFile
+	db.mu.RLock()
+	dataFile := db.refDataFile(logpos.Fid)
+	db.mu.RUnlock()
+
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	defer dataFile.Unref()
+	return readValueFromFile(dataFile, logpos)
+}
 
-	if db.activefile.FileId == logpos.Fid {
+// 根据文件ID找到数据文件并增加引用，使用完毕后需要调用 Unref
+// （在访问此方法前必须持有读锁）
+func (db *DB) refDataFile(fid uint32) *data.DataFile {
+	var dataFile *data.DataFile
+	if db.activefile != nil && db.activefile.FileId == fid {
 		dataFile = db.activefile
 	} else {
-		dataFile = db.olderfile[logpos.Fid]
+		dataFile = db.olderfile[fid]
+	}
+	if dataFile != nil {
+		dataFile.Ref()
+	}
+	return dataFile
+}
+
+// 记录一条无效数据，同时计入其所在的数据文件
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) addDeletedSize(pos *data.LogRecordPos) {
+	db.DeletedSize += int64(pos.Size)
+	if db.activefile != nil && db.activefile.FileId == pos.Fid {
+		db.activefile.DeadSize += int64(pos.Size)
+	} else if dataFile := db.olderfile[pos.Fid]; dataFile != nil {
+		dataFile.DeadSize += int64(pos.Size)
+	}
+}
+
+// 引用当前所有的数据文件，被引用的文件在 Merge 之后依然可以读取
+// （在访问此方法前必须持有读锁）
+func (db *DB) refDataFiles() map[uint32]*data.DataFile {
+	files := make(map[uint32]*data.DataFile, len(db.olderfile)+1)
+	for fid, dataFile := range db.olderfile {
+		dataFile.Ref()
+		files[fid] = dataFile
+	}
+	if db.activefile != nil {
+		db.activefile.Ref()
+		files[db.activefile.FileId] = db.activefile
 	}
+	return files
+}
 
+// 释放 refDataFiles 引用的数据文件
+func unrefDataFiles(files map[uint32]*data.DataFile) {
+	for _, dataFile := range files {
+		dataFile.Unref()
+	}
+}
+
+// 从指定的数据文件中读取索引位置对应的Value
+func readValueFromFile(dataFile *data.DataFile, logpos *data.LogRecordPos) ([]byte, error) {
 	//判断数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
@@ -359,8 +543,67 @@ func (db *DB) getValueByPostion(logpos *data.LogRecordPos) ([]byte, error) {
 	return logrecord.Value, nil
 }
 
-// 写入数据到活跃文件
+// 追加写入一条数据，并在持有锁时通过 apply 更新内存索引，保证索引的更新顺序和写入顺序一致
+// 开启 SyncWrites 时通过组提交合并持久化操作
+func (db *DB) appendLogRecordWithLock(key []byte, logrecord *data.LogRecord, apply func(pos *data.LogRecordPos)) error {
+	if db.options.SyncWrites {
+		req := &commitRequest{
+			//写入时就记录被修改的key，同一组中排在后面的乐观事务才能检测到冲突
+			prepare: func() ([]*data.LogRecord, error) {
+				db.trackWriteLocked(key)
+				return []*data.LogRecord{logrecord}, nil
+			},
+			apply: func(positions []*data.LogRecordPos) {
+				apply(positions[0])
+			},
+			sync: true,
+		}
+		return db.commit(req)
+	}
+
+	//组提交在持久化期间释放了 db.mu，此时组内的数据已经写入但还没有更新索引
+	//持有写入令牌才能保证这条数据排在整个组之后，索引不会被组内更旧的位置覆盖
+	db.commitToken <- struct{}{}
+	defer func() { <-db.commitToken }()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	pos, err := db.appendLogRecord(logrecord)
+	if err != nil {
+		return err
+	}
+	apply(pos)
+	return nil
+}
+
+// 写入数据到活跃文件，并根据配置决定是否持久化
+// （在访问此方法前必须持有互斥锁）
 func (db *DB) appendLogRecord(logrecord *data.LogRecord) (*data.LogRecordPos, error) {
+	pos, err := db.writeLogRecord(logrecord)
+	if err != nil {
+		return nil, err
+	}
+
+	//判断是否需要安全持久化
+	if db.needSync() {
+		if err := db.activefile.Sync(); err != nil {
+			return nil, err
+		}
+		db.bytesWrite = 0
+	}
+	return pos, nil
+}
+
+// 根据配置判断写入之后是否需要持久化
+func (db *DB) needSync() bool {
+	if db.options.SyncWrites {
+		return true
+	}
+	return db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync
+}
+
+// 写入数据到活跃文件，不做持久化
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) writeLogRecord(logrecord *data.LogRecord) (*data.LogRecordPos, error) {
 	//判断当前活跃数据文件是否存在，因为数据库在没有写入过的时候无活跃文件
 	//如果为空则初始化数据文件
 	if db.activefile == nil {
@@ -369,23 +612,23 @@ func (db *DB) appendLogRecord(logrecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 
-	//写入数据编码
-	enRecord, size := data.Encode_LogRecord(logrecord)
+	//写入数据编码，加密文件中的数据需要使用该文件的密钥编码
+	enRecord, size := db.activefile.EncodeRecord(logrecord)
 
 	//如果写入的数据超过活跃文件阈值，则关闭活跃文件，并打开新的文件
 	if db.activefile.Writeoff+size > db.options.DataFileSize {
-		//先持久数据文件，保证数据持久化到磁盘
-		if err := db.activefile.Sync(); err != nil {
+		//当前活跃文件编程旧的数据文件
+		if err := db.sealActiveFile(); err != nil {
 			return nil, err
 		}
 
-		//当前活跃文件编程旧的数据文件
-		db.olderfile[db.activefile.FileId] = db.activefile
-
 		//打开新的活跃文件
 		if err := db.setActiveDataFile(); err != nil {
 			return nil, err
 		}
+		if db.activefile.Encrypted() {
+			enRecord, size = db.activefile.EncodeRecord(logrecord)
+		}
 	}
 	res_writeoff := db.activefile.Writeoff
 	if err := db.activefile.Write(enRecord); err != nil {
@@ -393,24 +636,11 @@ func (db *DB) appendLogRecord(logrecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 
 	db.bytesWrite += uint(size)
-	//判断是否需要安全持久化
-	var needSync = db.options.SyncWrites
-	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
-		needSync = true
-	}
-
-	if needSync {
-		if err := db.activefile.Sync(); err != nil {
-			return nil, err
-		}
-		if db.bytesWrite > 0 {
-			db.bytesWrite = 0
-		}
-	}
 	return &data.LogRecordPos{
-		Fid:    db.activefile.FileId,
-		Offset: res_writeoff,
-		Size:   uint32(size),
+		Fid:      db.activefile.FileId,
+		Offset:   res_writeoff,
+		Size:     uint32(size),
+		ExpireAt: logrecord.ExpireAt,
 	}, nil
 }
 
@@ -422,11 +652,55 @@ func (db *DB) setActiveDataFile() error {
 		//当前活跃文件ID为最大文件ID
 		initialFiled = db.activefile.FileId + 1
 	}
+	return db.openActiveDataFile(initialFiled)
+}
 
-	dataFile, err := data.OpenDataFile(db.options.Dirpath, initialFiled, fio.StandardFio)
+// 活跃文件的加密方式和当前密钥不一致时，切换到新的活跃文件
+// 旧文件中的数据在 Merge 时使用当前密钥重写
+func (db *DB) rotateActiveFileForKey() error {
+	if db.activefile == nil {
+		return nil
+	}
+	ok, err := db.activefile.KeyMatches(db.options.EncryptionKeys)
+	if err != nil || ok {
+		return err
+	}
+	if err := db.sealActiveFile(); err != nil {
+		return err
+	}
+	return db.setActiveDataFile()
+}
+
+// 持久化活跃文件并转为旧文件，之后需要打开新的活跃文件
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) sealActiveFile() error {
+	if err := db.activefile.Sync(); err != nil {
+		return err
+	}
+	if err := db.activefile.Seal(); err != nil {
+		return err
+	}
+	db.olderfile[db.activefile.FileId] = db.activefile
+	db.writeHintFileAsync(db.activefile)
+	if db.options.MMapSealedFiles {
+		return db.mapSealedFile(db.activefile)
+	}
+	return nil
+}
+
+// 创建指定id的数据文件并作为Active
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) openActiveDataFile(fileId uint32) error {
+	dataFile, err := data.OpenDataFile(db.options.Dirpath, fileId, fio.StandardFio, db.options.EncryptionKeys)
 	if err != nil {
 		return err
 	}
+	if db.options.MMapWrite {
+		if err := dataFile.SetMMapWriter(db.options.Dirpath, db.options.DataFileSize); err != nil {
+			_ = dataFile.Close()
+			return err
+		}
+	}
 	db.activefile = dataFile
 	return nil
 }
@@ -438,12 +712,48 @@ func checkoptions(options Options) error {
 	if options.DataFileSize <= 0 {
 		return errors.New("database data file size must be greater than 0")
 	}
-	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
+	if options.RecoveryMode < RecoverStrict || options.RecoveryMode > RecoverSkipCorrupt {
+		return errors.New("invalid recovery mode")
+	}
+	if options.ShardHash < 0 || options.ShardHash > ShardHashSum {
+		return errors.New("invalid shard hash type")
+	}
+	if options.Compression > CompressionZstd {
+		return errors.New("invalid compression type")
+	}
+	//B+树索引启动时不扫描数据文件，无法识别活跃文件中预留的空间
+	if options.MMapWrite && options.IndexType == BPlusTree {
+		return errors.New("mmap write is not supported with B+ tree index")
+	}
+	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 ||
+		options.SelectiveMergeRatio < 0 || options.SelectiveMergeRatio > 1 {
 		return errors.New("invalid merge ratio,must between 0 and 1")
 	}
+	if options.IndexSnapshotInterval < 0 {
+		return errors.New("index snapshot interval must not be negative")
+	}
+	if options.LoadConcurrency < 0 {
+		return errors.New("load concurrency must not be negative")
+	}
+	if options.AutoMergeInterval < 0 || options.MaxConcurrentMerges < 0 {
+		return errors.New("auto merge interval and max concurrent merges must not be negative")
+	}
+	if options.AutoMergeWindowStart < 0 || options.AutoMergeWindowStart >= 24*time.Hour ||
+		options.AutoMergeWindowEnd < 0 || options.AutoMergeWindowEnd >= 24*time.Hour {
+		return errors.New("invalid auto merge window,must between 0 and 24h")
+	}
 	return nil
 }
 
+// 根据配置创建内存索引
+func newIndexer(options Options) index.Indexer {
+	hash := index.NewHashFunc(options.ShardHash)
+	if options.ShardHashFunc != nil {
+		hash = options.ShardHashFunc
+	}
+	return index.NEWIndexer(options.IndexType, options.Dirpath, options.SyncWrites, options.IndexNum, hash)
+}
+
 // 加载磁盘中的数据文件，构建File表
 func (db *DB) loadDataFiles() error {
 	dirEntries, err := os.ReadDir(db.options.Dirpath)
@@ -476,7 +786,7 @@ func (db *DB) loadDataFiles() error {
 		Iotype = fio.MemoryMap
 	}
 	for i, fid := range fileIds {
-		datafile, err := data.OpenDataFile(db.options.Dirpath, uint32(fid), Iotype)
+		datafile, err := data.OpenDataFile(db.options.Dirpath, uint32(fid), Iotype, db.options.EncryptionKeys)
 		if err != nil {
 			return err
 		}
@@ -492,8 +802,8 @@ func (db *DB) loadDataFiles() error {
 }
 
 // 从数据文件加载索引
-// 遍历文件中的所有记录，并更新到内存索引数据结构中
-func (db *DB) loadIndexFromDataFiles() error {
+// 遍历文件中的所有记录，并更新到内存索引数据结构中，snapshot 不为空时只加载快照之后的数据
+func (db *DB) loadIndexFromDataFiles(snapshot *indexSnapshot) error {
 	//没有文件，数据库为空
 	if len(db.fileIds) == 0 {
 		return nil
@@ -511,86 +821,106 @@ func (db *DB) loadIndexFromDataFiles() error {
 	// 	nonMergeFileId = fid
 	// }
 
+	now := time.Now().UnixNano()
 	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
 		var oldpos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
+		//已经过期的数据等同于被删除
+		deleted := typ == data.LogRecordDeleted || pos.Expired(now)
+		if deleted {
 			oldpos, _ = db.index.Delete(key)
-			db.DeletedSize += int64(pos.Size)
+			db.addDeletedSize(pos)
 		} else {
 			oldpos = db.index.Put(key, pos)
 		}
-		if oldpos != nil {
-			db.DeletedSize += int64(oldpos.Size)
+		if oldpos == nil {
+			return
+		}
+		//Hint文件中的位置比当前数据更新，当前数据已经无效，恢复原来的索引
+		if oldpos.Fid > pos.Fid {
+			db.index.Put(key, oldpos)
+			if !deleted {
+				db.addDeletedSize(pos)
+			}
+			return
+		}
+		//从Hint文件加载过的同一条数据
+		if oldpos.Fid == pos.Fid && oldpos.Offset == pos.Offset {
+			return
 		}
+		db.addDeletedSize(oldpos)
 	}
 
 	//暂存事务数据的<key,pos>（seqNo != NonTransactionSewNo)
 	//待检查到事务完成标记Log后再更新Index-table
 	transactionRecords := make(map[int64][]*data.TransactionRecords)
 	var maxSeq int64 = NonTransactionSewNo
+	if snapshot != nil {
+		maxSeq = snapshot.seqNo
+	}
 
-	//遍历所有文件id,处理文件的记录
-	for i, fid := range db.fileIds {
-		var fileid = uint32(fid)
-		var dataFile *data.DataFile
-
-		// if hasMerge && fileid < nonMergeFileId {
-		// 	continue
-		// }
-
-		//根据fileid得到 DataFile接口
-		if fileid == db.activefile.FileId {
-			dataFile = db.activefile
+	//处理一条数据，数据来自数据文件或者数据文件的 Hint
+	handleRecord := func(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
+		//解析 Key,拿到事物序列号
+		realkey, seqNo := parseLogRecordKey(key)
+		if seqNo == NonTransactionSewNo {
+			//非事务操作，直接更新内存索引
+			updateIndex(realkey, typ, logRecordPos)
 		} else {
-			dataFile = db.olderfile[fileid]
-		}
-
-		var offset int64 = 0
-		//循环遍历Entry，目的是得到每个Entry所在的Offset,装入Index
-		for {
-			logRecord, size, err := dataFile.ReadRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
+			//事务完成，对应的seq No 的数据可以更新到内存索引中
+			if typ == data.LogRecordTxnFinished {
+				for _, txnRecord := range transactionRecords[seqNo] {
+					updateIndex(txnRecord.Key, txnRecord.Type, txnRecord.Pos)
 				}
-				return err
-			}
-
-			//构造内存索引并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileid, Offset: offset, Size: uint32(size)}
-
-			//解析 Key,拿到事物序列号
-			realkey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == NonTransactionSewNo {
-				//非事务操作，直接更新内存索引
-				updateIndex(realkey, logRecord.Type, logRecordPos)
+				delete(transactionRecords, seqNo)
+				//事务完成标记本身是无效数据
+				db.addDeletedSize(logRecordPos)
 			} else {
-				//事务完成，对应的seq No 的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Key, txnRecord.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					txnRecord := data.TransactionRecords{
-						Key:  realkey,
-						Type: logRecord.Type,
-						Pos:  logRecordPos,
-					}
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &txnRecord)
+				txnRecord := data.TransactionRecords{
+					Key:  realkey,
+					Type: typ,
+					Pos:  logRecordPos,
 				}
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], &txnRecord)
 			}
-			//维护最新SeqNo
-			maxSeq = max(maxSeq, seqNo)
-
-			//递增offset到下一个Entry
-			offset += size
 		}
+		//维护最新SeqNo
+		maxSeq = max(maxSeq, seqNo)
+	}
 
+	//按照文件id的顺序处理每个文件的数据，文件的解码并发进行
+	dataFiles := make([]*data.DataFile, 0, len(db.fileIds))
+	var from int64
+	for _, fid := range db.fileIds {
+		//快照已经包含的文件不需要加载，快照时的活跃文件从快照的位置开始加载
+		if snapshot != nil && uint32(fid) < snapshot.fileId {
+			continue
+		}
+		//根据fileid得到 DataFile接口
+		if uint32(fid) == db.activefile.FileId {
+			dataFiles = append(dataFiles, db.activefile)
+		} else {
+			dataFiles = append(dataFiles, db.olderfile[uint32(fid)])
+		}
+	}
+	if snapshot != nil {
+		from = snapshot.offset
+	}
+	err := db.decodeDataFiles(dataFiles, from, func(i int, file *loadedFile) error {
+		db.recovery.merge(file.recovery)
+		if file.err != nil {
+			return file.err
+		}
+		for _, entry := range file.entries {
+			handleRecord(entry.key, entry.typ, entry.pos)
+		}
 		//如果当前是活跃文件，维护活跃文件的Writeoff
-		if i == len(db.fileIds)-1 {
-			db.activefile.Writeoff = offset
+		if i == len(dataFiles)-1 {
+			db.activefile.Writeoff = file.writeoff
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	db.seqNo = maxSeq
@@ -602,11 +932,11 @@ func (db *DB) loadSeqNo() error {
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		return nil
 	}
-	seqNoFile, err := data.OpenSeqNoFile(db.options.Dirpath)
+	seqNoFile, err := data.OpenSeqNoFile(db.options.Dirpath, db.options.EncryptionKeys)
 	if err != nil {
 		return err
 	}
-	record, _, _ := seqNoFile.ReadRecord(0)
+	record, _, _ := seqNoFile.ReadRecord(seqNoFile.DataOffset())
 	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
 	if err != nil {
 		return err
@@ -623,6 +953,10 @@ func (db *DB) resetIoType() error {
 	if err := db.activefile.SetIoManager(db.options.Dirpath, fio.StandardFio); err != nil {
 		return err
 	}
+	//旧文件保持内存映射
+	if db.options.MMapSealedFiles {
+		return nil
+	}
 	for _, dataFile := range db.olderfile {
 		if err := dataFile.SetIoManager(db.options.Dirpath, fio.StandardFio); err != nil {
 			return err
@@ -631,8 +965,27 @@ func (db *DB) resetIoType() error {
 	return nil
 }
 
+// 使用内存映射重新打开旧文件，原来的文件在引用释放之后关闭
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) mapSealedFile(dataFile *data.DataFile) error {
+	if dataFile.MemoryMapped() {
+		return nil
+	}
+	mapped, err := data.OpenDataFile(db.options.Dirpath, dataFile.FileId, fio.MemoryMap, db.options.EncryptionKeys)
+	if err != nil {
+		return err
+	}
+	mapped.Writeoff = dataFile.Writeoff
+	mapped.DeadSize = dataFile.DeadSize
+	db.olderfile[dataFile.FileId] = mapped
+	dataFile.Retire()
+	return nil
+}
+
 // 存储引擎状态信息
 func (db *DB) Stat() *Stat {
+	//在加锁之前等待正在生成的 Hint 文件完成，持有读锁等待会阻塞所有的写入
+	db.hintWg.Wait()
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -644,16 +997,71 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Errorf("failed to get dir size"))
 	}
+
+	fileStats := make([]FileStat, 0, files)
+	for _, dataFile := range db.olderfile {
+		fileStats = append(fileStats, newFileStat(dataFile))
+	}
+	if db.activefile != nil {
+		fileStats = append(fileStats, newFileStat(db.activefile))
+	}
+	sort.Slice(fileStats, func(i, j int) bool {
+		return fileStats[i].FileId < fileStats[j].FileId
+	})
+	var shardKeys []int
+	var shardSkew float64
+	if sharded, ok := db.index.(index.Sharded); ok {
+		shardKeys = sharded.ShardSizes()
+		shardSkew = shardBalance(shardKeys)
+	}
 	return &Stat{
 		KeyNum:      uint(db.index.Size()),
 		DataFileNum: files,
 		DeletedSize: db.DeletedSize,
 		DiskSize:    dirSize,
+
+		AutoMergeRuns: db.autoMergeRuns,
+		LastAutoMerge: db.lastAutoMerge,
+
+		Files: fileStats,
+
+		ShardKeys: shardKeys,
+		ShardSkew: shardSkew,
+	}
+}
+
+// 最大分片和平均值的比值，没有数据时为 0
+func shardBalance(sizes []int) float64 {
+	var total, largest int
+	for _, size := range sizes {
+		total += size
+		largest = max(largest, size)
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(largest) * float64(len(sizes)) / float64(total)
+}
+
+func newFileStat(dataFile *data.DataFile) FileStat {
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		panic(fmt.Errorf("failed to get data file size"))
+	}
+	return FileStat{
+		FileId:    dataFile.FileId,
+		LiveSize:  size - dataFile.DeadSize,
+		DeadSize:  dataFile.DeadSize,
+		Encrypted: dataFile.Encrypted(),
+		KeyId:     dataFile.KeyId(),
 	}
 }
 
 // BackUp 备份数据库，将数据文件拷贝到新的目录
 func (db *DB) BackUp(dest string) error {
+	//在加锁之前等待正在生成的 Hint 文件完成
+	//之后才开始生成的 Hint 文件没有结束标记，在备份中启动时会被忽略
+	db.hintWg.Wait()
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	return utils.CopyDir(db.options.Dirpath, dest, []string{fileLockName})
@@ -1,11 +1,13 @@
 package bitcaskkvdb
 
 import (
+	"bitcask/data"
 	"bitcask/utils"
 	"bytes"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +18,8 @@ func destroyDB(db *DB) {
 		if db.activefile != nil {
 			_ = db.activefile.Close()
 		}
+		//启动时为旧文件生成 Hint 文件的协程可能还在写入
+		db.hintWg.Wait()
 		err := os.RemoveAll(db.options.Dirpath)
 		if err != nil {
 			panic(err)
@@ -434,6 +438,97 @@ func TestStat(t *testing.T) {
 	t.Log(stat)
 }
 
+func TestStat_ShardKeys(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(4)))
+	}
+	stat := db.Stat()
+	assert.Equal(t, int(opts.IndexNum), len(stat.ShardKeys))
+	var total int
+	for _, keys := range stat.ShardKeys {
+		total += keys
+	}
+	assert.Equal(t, int(stat.KeyNum), total)
+	assert.Less(t, stat.ShardSkew, 1.1)
+	assert.Nil(t, db.Close())
+
+	//自定义的哈希函数代替 ShardHash
+	opts.ShardHashFunc = func(key []byte) uint64 { return 3 }
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stat = db2.Stat()
+	assert.Equal(t, 10000, stat.ShardKeys[3])
+	assert.Equal(t, float64(opts.IndexNum), stat.ShardSkew)
+	assert.Nil(t, db2.Close())
+
+	//非分片的索引没有分片统计
+	opts.IndexType = Btree
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	stat = db3.Stat()
+	assert.Nil(t, stat.ShardKeys)
+	assert.Equal(t, float64(0), stat.ShardSkew)
+	assert.Nil(t, db3.Close())
+
+	opts.ShardHash = ShardHashSum + 1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_HashMapIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = HashMap
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	val, err := db.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1000), val)
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFind, err)
+
+	//遍历时按照key排序
+	keys := db.ListKeys()
+	assert.Equal(t, 1500, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, utils.GetTestKey(500+i), key)
+	}
+	iteropts := DefalutIteratorOptions
+	iteropts.Reverse = true
+	iter := db.NewIterator(iteropts)
+	assert.Equal(t, utils.GetTestKey(1999), iter.Key())
+	iter.Close()
+	assert.Equal(t, 10, len(db.Stat().ShardKeys))
+
+	//Merge 和重启之后数据不变
+	db.options.DataFileMergeRatio = 0
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1500, len(db2.ListKeys()))
+	val, err = db2.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1999), val)
+}
+
 func TestBackUp(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp("", "bitcask-go")
@@ -468,3 +563,342 @@ func TestBackUp(t *testing.T) {
 
 	assert.Equal(t, stat, stat2)
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 64 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	//1、未过期的数据可以正常读取
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), time.Hour)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	//2、过期的数据视为不存在
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(24), time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(24))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 5)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFind, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	var folded int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		assert.NotEqual(t, utils.GetTestKey(2), key)
+		folded++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, folded)
+
+	//3、重新Put后不再过期
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(24))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	//4、重启之后过期时间依然有效
+	err = db.PutWithTTL(utils.GetTestKey(4), utils.RandomValue(24), time.Millisecond)
+	assert.Nil(t, err)
+	db.Close()
+	time.Sleep(time.Millisecond * 5)
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFind, err)
+	val, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Equal(t, 3, len(db2.ListKeys()))
+}
+
+func TestDB_LegacyFileFormat(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+
+	//构造没有文件头的旧格式数据目录
+	var content []byte
+	for i := 0; i < 10; i++ {
+		encRecord, _ := data.Encode_LogRecord(&data.LogRecord{
+			Key:   LogRecordKeyWithSeq(utils.GetTestKey(i), NonTransactionSewNo),
+			Value: utils.GetTestKey(i),
+		})
+		content = append(content, encRecord...)
+	}
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, 0), content, 0644))
+
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.activefile.Header)
+	assert.Equal(t, 10, len(db.ListKeys()))
+	val, err := db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(3), val)
+
+	//旧格式文件继续追加写入
+	assert.Nil(t, db.Put(utils.GetTestKey(10), utils.GetTestKey(10)))
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(db2.ListKeys()))
+
+	//Merge 之后所有文件都升级为新格式
+	db2.options.DataFileMergeRatio = 0
+	assert.Nil(t, db2.Merge())
+	for _, dataFile := range db2.olderfile {
+		assert.NotNil(t, dataFile.Header)
+	}
+	assert.NotNil(t, db2.activefile.Header)
+	assert.Nil(t, db2.Close())
+
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(db3.ListKeys()))
+	val, err = db3.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	assert.Nil(t, db3.Close())
+
+	//更高版本写入的文件拒绝打开
+	header := data.EncodeFileHeader(&data.FileHeader{Version: data.FileFormatVersion + 1})
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, 100), header, 0644))
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrUnsupportedFileVersion, err)
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	value := bytes.Repeat([]byte(`{"id":1,"name":"bitcask","tags":["go","kv"]},`), 50)
+
+	//不同压缩算法写入的数据混合存在
+	types := []CompressionType{CompressionNone, CompressionSnappy, CompressionDeflate, CompressionZstd}
+	for i, tp := range types {
+		opts.Compression = tp
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for j := 0; j < 100; j++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i*100+j), value))
+		}
+		wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+		assert.Nil(t, wb.Put(utils.GetTestKey(1000+i), value))
+		assert.Nil(t, wb.Commit())
+		assert.Nil(t, db.Close())
+	}
+
+	opts.Compression = CompressionNone
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, len(types)*101, len(db.ListKeys()))
+	for i := range types {
+		val, err := db.Get(utils.GetTestKey(i*100 + 1))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+		val, err = db.Get(utils.GetTestKey(1000 + i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	//Merge 时按照当前配置重新压缩
+	db.options.Compression = CompressionSnappy
+	db.options.DataFileMergeRatio = 0
+	before, _ := utils.DirSize(dir)
+	assert.Nil(t, db.Merge())
+	after, _ := utils.DirSize(dir)
+	assert.Less(t, after, before)
+	assert.Nil(t, db.Fold(func(key []byte, val []byte) bool {
+		assert.Equal(t, value, val)
+		return true
+	}))
+	assert.Nil(t, db.Close())
+
+	_, err = Open(Options{Dirpath: dir, DataFileSize: 1024, IndexType: Btree, Compression: CompressionZstd + 1})
+	assert.NotNil(t, err)
+}
+
+func TestDB_MMapWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MMapWrite = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	val, err := db.Get(utils.GetTestKey(500))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	//写满的文件截断了预留的空间
+	assert.Greater(t, len(db.olderfile), 1)
+	for _, dataFile := range db.olderfile {
+		info, err := os.Stat(data.GetDataFileName(dir, dataFile.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, dataFile.Writeoff, info.Size())
+	}
+	info, err := os.Stat(data.GetDataFileName(dir, db.activefile.FileId))
+	assert.Nil(t, err)
+	assert.Equal(t, opts.DataFileSize, info.Size())
+
+	//模拟进程崩溃：活跃文件尾部留有预留的空间
+	assert.Nil(t, db.Sync())
+	crashDir, _ := os.MkdirTemp("", "bitcask-go")
+	assert.Nil(t, db.BackUp(crashDir))
+	crashOpts := opts
+	crashOpts.Dirpath = crashDir
+	crashOpts.RecoveryMode = RecoverStrict
+	db2, err := Open(crashOpts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 900, len(db2.ListKeys()))
+	assert.Equal(t, 0, len(db2.RecoveryReport().Corruptions))
+	assert.Nil(t, db2.Put(utils.GetTestKey(1000), []byte("after crash")))
+	assert.Nil(t, db2.Close())
+
+	//关闭之后截断，可以用标准文件 Io 打开
+	assert.Nil(t, db.Close())
+	opts.MMapWrite = false
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 900, len(db3.ListKeys()))
+	assert.Nil(t, db3.Put(utils.GetTestKey(1000), []byte("standard io")))
+	assert.Nil(t, db3.Close())
+
+	opts.MMapWrite = true
+	db4, err := Open(opts)
+	defer destroyDB(db4)
+	assert.Nil(t, err)
+	val, err = db4.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("standard io"), val)
+
+	//Merge 生成的文件同样截断
+	db4.options.DataFileMergeRatio = 0
+	assert.Nil(t, db4.Merge())
+	assert.Equal(t, 901, len(db4.ListKeys()))
+	for _, dataFile := range db4.olderfile {
+		info, err := os.Stat(data.GetDataFileName(dir, dataFile.FileId))
+		assert.Nil(t, err)
+		size, _ := dataFile.IoManager.Size()
+		assert.Equal(t, size, info.Size())
+	}
+}
+
+func TestDB_MMapSealedFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.MMapSealedFiles = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	//迭代器引用的文件在重新映射之后仍然可以读取
+	iter := db.NewIterator(DefalutIteratorOptions)
+
+	//写入期间并发读取，活跃文件写满时重新映射
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < 200; i++ {
+					val, err := db.Get(utils.GetTestKey(i))
+					assert.Nil(t, err)
+					assert.Equal(t, utils.GetTestKey(i), val)
+				}
+			}
+		}()
+	}
+	for i := 200; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	close(stop)
+	wg.Wait()
+
+	//ART 索引迭代器按需读取，创建之后写入的key同样可以遍历到
+	var iterated, old int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		if bytes.Compare(iter.Key(), utils.GetTestKey(200)) < 0 {
+			assert.Equal(t, iter.Key(), val)
+			old++
+		}
+		iterated++
+	}
+	assert.Equal(t, 200, old)
+	assert.Equal(t, 2000, iterated)
+	iter.Close()
+
+	assert.Greater(t, len(db.olderfile), 2)
+	for _, dataFile := range db.olderfile {
+		assert.True(t, dataFile.MemoryMapped())
+	}
+	assert.False(t, db.activefile.MemoryMapped())
+
+	//Merge 生成的文件同样使用内存映射
+	db.options.DataFileMergeRatio = 0
+	assert.Nil(t, db.Merge())
+	for _, dataFile := range db.olderfile {
+		assert.True(t, dataFile.MemoryMapped())
+	}
+	assert.Nil(t, db.Close())
+
+	//启动时不使用内存映射加载，加载之后映射旧文件
+	opts.MMapOpen = false
+	opts.MMapWrite = true
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	for _, dataFile := range db2.olderfile {
+		assert.True(t, dataFile.MemoryMapped())
+	}
+	for i := 0; i < 2000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, db2.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	val, err := db2.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	assert.Equal(t, 3000, len(db2.ListKeys()))
+}
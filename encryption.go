@@ -0,0 +1,44 @@
+package bitcaskkvdb
+
+import "sync"
+
+// StaticKeyProvider 保存在内存中的密钥集合，可以在运行期间加入新的密钥并切换当前密钥
+type StaticKeyProvider struct {
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewStaticKeyProvider 创建只有一个密钥的 StaticKeyProvider，该密钥作为当前密钥
+func NewStaticKeyProvider(id uint32, key []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		keys:    map[uint32][]byte{id: key},
+		current: id,
+	}
+}
+
+// AddKey 加入密钥，current 为 true 时之后创建的文件使用该密钥
+func (p *StaticKeyProvider) AddKey(id uint32, key []byte, current bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[id] = key
+	if current {
+		p.current = id
+	}
+}
+
+func (p *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
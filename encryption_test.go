@@ -0,0 +1,115 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.Compression = CompressionSnappy
+	keys := NewStaticKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+	opts.EncryptionKeys = keys
+	secret := []byte("customer-secret-value")
+
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), append(bytes.Repeat(secret, 4), byte(i))))
+	}
+	wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch-key"), secret))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db.Close())
+
+	//磁盘上没有明文
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(content, secret), entry.Name())
+		assert.False(t, bytes.Contains(content, []byte("bitcask-go-key")), entry.Name())
+	}
+
+	//没有密钥或者密钥错误时无法启动
+	opts.EncryptionKeys = nil
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrEncryptionKeyRequired, err)
+	opts.EncryptionKeys = NewStaticKeyProvider(1, bytes.Repeat([]byte{2}, 32))
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrDecryptFailed, err)
+
+	opts.EncryptionKeys = keys
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(db2.ListKeys()))
+	val, err := db2.Get([]byte("batch-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, secret, val)
+
+	//轮换密钥，新文件使用新密钥，Merge 时用新密钥重写旧文件
+	keys.AddKey(2, bytes.Repeat([]byte{3}, 16), true)
+	assert.Nil(t, db2.Put(utils.GetTestKey(1000), secret))
+	assert.Nil(t, db2.Merge())
+	for _, file := range db2.Stat().Files {
+		assert.True(t, file.Encrypted)
+		assert.Equal(t, uint32(2), file.KeyId)
+	}
+	val, err = db2.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, append(bytes.Repeat(secret, 4), byte(10)), val)
+	assert.Nil(t, db2.Close())
+
+	//轮换之后只需要新密钥
+	opts.EncryptionKeys = NewStaticKeyProvider(2, bytes.Repeat([]byte{3}, 16))
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, len(db3.ListKeys()))
+	val, err = db3.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, secret, val)
+	assert.Nil(t, db3.Close())
+}
+
+func TestDB_EnableEncryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Close())
+
+	//已有的明文数据目录开启加密，新的数据写入加密文件
+	opts.EncryptionKeys = NewStaticKeyProvider(7, bytes.Repeat([]byte{7}, 32))
+	opts.SelectiveMergeRatio = 0.9
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.True(t, db2.activefile.Encrypted())
+	assert.Nil(t, db2.Put(utils.GetTestKey(100), utils.RandomValue(24)))
+
+	//选择性 Merge 时明文文件也会被重写
+	assert.Nil(t, db2.Merge())
+	for _, file := range db2.Stat().Files {
+		assert.True(t, file.Encrypted)
+	}
+	assert.Equal(t, 101, len(db2.ListKeys()))
+}
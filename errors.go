@@ -9,6 +9,11 @@ var ErrDataFileNotFound = errors.New("datafile is not found")
 var ErrDataDirCorrupted = errors.New("the database directory maybe corrupted")
 var ErrExceedMaxBatchNum = errors.New("exceed max batch num")
 var ErrMergeIsProgress = errors.New("Merge is Progress")
+var ErrMergeFileIdExhausted = errors.New("merged data files exceed the reserved file ids")
 var ErrDataBaseIsUsing = errors.New("database is using")
 var ErrNotOverMergeRatio = errors.New("lower than Merge Ratio")
 var ErrNoEnoughSpaceForMerge = errors.New("no enougn disk space for merge")
+var ErrSnapshotReleased = errors.New("snapshot has been released")
+var ErrTxnConflict = errors.New("transaction conflict,keys read have been modified")
+var ErrEncryptionKeyNotFound = errors.New("encryption key is not found")
+var ErrTxnClosed = errors.New("transaction has been committed or rolled back")
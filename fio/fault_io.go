@@ -0,0 +1,268 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrInjectedFault  = errors.New("injected io fault")
+	ErrSimulatedCrash = errors.New("io manager is unavailable after simulated crash")
+)
+
+// FaultInjector 在 IOManager 上注入故障，用于测试写入失败和崩溃之后的数据一致性
+// 通过 Factory 打开的所有文件共享同一组故障设置，写入次数在所有文件之间累计
+type FaultInjector struct {
+	mu       sync.Mutex
+	newInner IOManagerFactory
+	files    map[*FaultIO]struct{} //打开中的文件，崩溃时丢弃其中没有持久化的数据
+	synced   map[string]int64      //每个文件已经持久化的长度
+	match    func(fileName string) bool
+
+	writes     int  //已经执行的写入次数
+	failAfter  int  //成功写入该次数之后的写入全部失败，小于 0 表示不失败
+	shortWrite bool //失败的写入是否写入一半数据
+	flipAfter  int  //成功写入该次数之后的下一次写入翻转一个比特，小于 0 表示不翻转
+	crashed    bool
+}
+
+// NewFaultInjector 创建故障注入器，inner 为实际读写数据的实现
+func NewFaultInjector(inner IOManagerFactory) *FaultInjector {
+	return &FaultInjector{
+		newInner:  inner,
+		files:     make(map[*FaultIO]struct{}),
+		synced:    make(map[string]int64),
+		failAfter: -1,
+		flipAfter: -1,
+	}
+}
+
+// Factory 返回注入故障的 IOManager 实现，可以通过 RegisterIoManager 注册
+func (fi *FaultInjector) Factory() IOManagerFactory {
+	return func(fileName string) (IOManager, error) {
+		fi.mu.Lock()
+		defer fi.mu.Unlock()
+		if fi.crashed {
+			return nil, ErrSimulatedCrash
+		}
+		inner, err := fi.newInner(fileName)
+		if err != nil {
+			return nil, err
+		}
+		size, err := inner.Size()
+		if err != nil {
+			_ = inner.Close()
+			return nil, err
+		}
+		//第一次打开时文件中已有的数据视为已经持久化
+		if synced, ok := fi.synced[fileName]; !ok || synced > size {
+			fi.synced[fileName] = size
+		}
+		fio := &FaultIO{fi: fi, inner: inner, fileName: fileName}
+		fi.files[fio] = struct{}{}
+		return fio, nil
+	}
+}
+
+// Filter 只对 match 返回 true 的文件注入写入故障和统计写入次数，崩溃对所有文件生效
+func (fi *FaultInjector) Filter(match func(fileName string) bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.match = match
+}
+
+// FailWritesAfter 再成功写入 n 次之后，所有的写入都返回 ErrInjectedFault
+// short 为 true 时失败的写入会先写入一半的数据，模拟磁盘写满等部分写入的情况
+func (fi *FaultInjector) FailWritesAfter(n int, short bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.failAfter = fi.writes + n
+	fi.shortWrite = short
+}
+
+// FlipBitAfter 再成功写入 n 次之后，下一次写入的数据中翻转一个比特，写入本身返回成功
+func (fi *FaultInjector) FlipBitAfter(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.flipAfter = fi.writes + n
+}
+
+// Heal 清除写入故障，不影响已经发生的崩溃
+func (fi *FaultInjector) Heal() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.failAfter = -1
+	fi.flipAfter = -1
+}
+
+// Writes 返回已经执行的写入次数，包括失败的写入
+func (fi *FaultInjector) Writes() int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.writes
+}
+
+// Crash 模拟进程崩溃，打开中的文件丢弃最后一次 Sync 之后写入的数据并关闭
+// 之后所有的读写都返回 ErrSimulatedCrash，已经关闭的文件视为已经持久化
+func (fi *FaultInjector) Crash() error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.crashed {
+		return nil
+	}
+	fi.crashed = true
+	var firstErr error
+	for fio := range fi.files {
+		if err := fio.dropUnsynced(fi.synced[fio.fileName]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := fio.inner.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	fi.files = make(map[*FaultIO]struct{})
+	return firstErr
+}
+
+// FaultIO 由 FaultInjector 创建的 IOManager
+type FaultIO struct {
+	fi       *FaultInjector
+	inner    IOManager
+	fileName string
+	closed   bool
+}
+
+// 截断到持久化的长度（在访问此方法前必须持有 fi.mu）
+func (fio *FaultIO) dropUnsynced(synced int64) error {
+	size, err := fio.inner.Size()
+	if err != nil || size <= synced {
+		return err
+	}
+	truncater, ok := fio.inner.(Truncater)
+	if !ok {
+		return errors.New("io manager does not support truncate")
+	}
+	return truncater.Truncate(synced)
+}
+
+// 检查文件是否可用（在访问此方法前必须持有 fi.mu）
+func (fio *FaultIO) check() error {
+	if fio.fi.crashed {
+		return ErrSimulatedCrash
+	}
+	if fio.closed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// Read从文件指定位置读取对应的数据
+func (fio *FaultIO) Read(b []byte, offset int64) (int, error) {
+	fio.fi.mu.Lock()
+	err := fio.check()
+	fio.fi.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return fio.inner.Read(b, offset)
+}
+
+// Write写入字符数组到文件中，按照 FaultInjector 的设置注入故障
+func (fio *FaultIO) Write(b []byte) (int, error) {
+	fi := fio.fi
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fio.check(); err != nil {
+		return 0, err
+	}
+	if fi.match != nil && !fi.match(fio.fileName) {
+		return fio.inner.Write(b)
+	}
+	fi.writes++
+	if fi.failAfter >= 0 && fi.writes > fi.failAfter {
+		if !fi.shortWrite || len(b) < 2 {
+			return 0, ErrInjectedFault
+		}
+		n, err := fio.inner.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, ErrInjectedFault
+	}
+	if fi.flipAfter >= 0 && fi.writes == fi.flipAfter+1 && len(b) > 0 {
+		flipped := make([]byte, len(b))
+		copy(flipped, b)
+		flipped[len(b)/2] ^= 0x01
+		b = flipped
+	}
+	return fio.inner.Write(b)
+}
+
+// Sync持久化数据，崩溃之后这部分数据仍然保留
+func (fio *FaultIO) Sync() error {
+	fi := fio.fi
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fio.check(); err != nil {
+		return err
+	}
+	if err := fio.inner.Sync(); err != nil {
+		return err
+	}
+	size, err := fio.inner.Size()
+	if err != nil {
+		return err
+	}
+	fi.synced[fio.fileName] = size
+	return nil
+}
+
+// Close关闭文件，崩溃之后关闭不会返回错误
+func (fio *FaultIO) Close() error {
+	fi := fio.fi
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.crashed || fio.closed {
+		return nil
+	}
+	fio.closed = true
+	delete(fi.files, fio)
+	//关闭的文件视为已经持久化
+	if size, err := fio.inner.Size(); err == nil {
+		fi.synced[fio.fileName] = size
+	}
+	return fio.inner.Close()
+}
+
+// Size获取文件大小
+func (fio *FaultIO) Size() (int64, error) {
+	fio.fi.mu.Lock()
+	err := fio.check()
+	fio.fi.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return fio.inner.Size()
+}
+
+// Truncate截断文件，被截断的部分不再需要持久化
+func (fio *FaultIO) Truncate(size int64) error {
+	fi := fio.fi
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fio.check(); err != nil {
+		return err
+	}
+	truncater, ok := fio.inner.(Truncater)
+	if !ok {
+		return errors.New("io manager does not support truncate")
+	}
+	if err := truncater.Truncate(size); err != nil {
+		return err
+	}
+	if fi.synced[fio.fileName] > size {
+		fi.synced[fio.fileName] = size
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package fio
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultIO_FailWrites(t *testing.T) {
+	defer RemoveMemFile("fault-a.data")
+	fi := NewFaultInjector(IoManagerFactory(MemoryIo))
+	fio, err := fi.Factory()("fault-a.data")
+	assert.Nil(t, err)
+
+	fi.FailWritesAfter(1, false)
+	_, err = fio.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	n, err := fio.Write([]byte("bbbb"))
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 0, n)
+
+	//部分写入
+	fi.FailWritesAfter(0, true)
+	n, err = fio.Write([]byte("cccc"))
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 2, n)
+	size, _ := fio.Size()
+	assert.Equal(t, int64(6), size)
+
+	fi.Heal()
+	_, err = fio.Write([]byte("dd"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, fi.Writes())
+}
+
+func TestFaultIO_FlipBit(t *testing.T) {
+	defer RemoveMemFile("fault-b.data")
+	fi := NewFaultInjector(IoManagerFactory(MemoryIo))
+	fio, _ := fi.Factory()("fault-b.data")
+
+	fi.FlipBitAfter(1)
+	data := []byte("aaaa")
+	for i := 0; i < 3; i++ {
+		_, err := fio.Write(data)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []byte("aaaa"), data)
+	b := make([]byte, 12)
+	_, _ = fio.Read(b, 0)
+	assert.Equal(t, []byte("aaaaaa`aaaaa"), b)
+}
+
+func TestFaultIO_Crash(t *testing.T) {
+	defer RemoveMemFile("fault-c.data")
+	defer RemoveMemFile("fault-d.data")
+	fi := NewFaultInjector(IoManagerFactory(MemoryIo))
+	f1, _ := fi.Factory()("fault-c.data")
+	f2, _ := fi.Factory()("fault-d.data")
+
+	_, _ = f1.Write([]byte("synced"))
+	assert.Nil(t, f1.Sync())
+	_, _ = f1.Write([]byte("lost"))
+	_, _ = f2.Write([]byte("lost"))
+
+	assert.Nil(t, fi.Crash())
+	_, err := f1.Write([]byte("x"))
+	assert.Equal(t, ErrSimulatedCrash, err)
+	_, err = fi.Factory()("fault-c.data")
+	assert.Equal(t, ErrSimulatedCrash, err)
+	assert.Nil(t, f1.Close())
+
+	//崩溃之后只保留持久化的数据
+	m1, _ := NewMemIOManager("fault-c.data")
+	size, _ := m1.Size()
+	assert.Equal(t, int64(6), size)
+	m2, _ := NewMemIOManager("fault-d.data")
+	size, _ = m2.Size()
+	assert.Equal(t, int64(0), size)
+}
@@ -21,6 +21,15 @@ func NewFileIOManger(fileName string) (*FileIO, error) {
 
 }
 
+// 只读打开已经存在的文件，文件不存在时返回错误，写入和截断都会失败
+func NewReadOnlyFileIOManager(fileName string) (*FileIO, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &FileIO{fd}, nil
+}
+
 // Read从文件指定位置读取对应的数据
 func (fio *FileIO) Read(b []byte, offset int64) (int, error) {
 	return fio.fd.ReadAt(b, offset)
@@ -41,6 +50,11 @@ func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
 
+// Truncate截断文件
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 // Size获取文件大小
 func (fio *FileIO) Size() (int64, error) {
 	stat, err := fio.fd.Stat()
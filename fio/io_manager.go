@@ -1,5 +1,10 @@
 package fio
 
+import (
+	"errors"
+	"sync"
+)
+
 const DataFileperm = 0644
 
 type FileIoType = byte
@@ -10,9 +15,14 @@ const (
 
 	//内存文件映射
 	MemoryMap
+
+	//纯内存文件，不写入磁盘，进程退出后丢失
+	MemoryIo
 )
 
-// IOManager 抽象IO管理接口，可以接入不同类型的IO，目前支持标准文件Io
+var ErrUnsupportedIoType = errors.New("unsupported io type")
+
+// IOManager 抽象IO管理接口，可以接入不同类型的IO，通过 RegisterIoManager 注册
 type IOManager interface {
 
 	//Read从文件指定位置读取对应的数据
@@ -31,16 +41,55 @@ type IOManager interface {
 	Size() (int64, error)
 }
 
-//初始化IOManager,目前只支持标准FileIo
+// ZeroCopyReader 可以直接返回文件内容而不需要拷贝的 IOManager
+// 返回的切片在文件关闭之后不能再访问，调用方不能修改也不能长期持有
+type ZeroCopyReader interface {
+	Bytes(n int64, offset int64) ([]byte, error)
+}
 
-func NewIoManager(fileName string, IoType FileIoType) (IOManager, error) {
+// Truncater 可以截断文件的 IOManager，截断之后从新的末尾继续写入
+type Truncater interface {
+	Truncate(size int64) error
+}
 
-	switch IoType {
-	case StandardFio:
-		return NewFileIOManger(fileName)
-	case MemoryMap:
-		return NewMMapIOManger(fileName)
-	default:
-		panic("unsupported io type")
+// IOManagerFactory 根据文件名打开 IOManager，文件不存在时创建
+type IOManagerFactory func(fileName string) (IOManager, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[FileIoType]IOManagerFactory{
+		StandardFio: func(fileName string) (IOManager, error) { return NewFileIOManger(fileName) },
+		MemoryMap:   func(fileName string) (IOManager, error) { return NewMMapIOManger(fileName) },
+		MemoryIo:    func(fileName string) (IOManager, error) { return NewMemIOManager(fileName) },
+	}
+)
+
+// RegisterIoManager 注册或替换 IoType 对应的 IOManager 实现，返回之前注册的实现
+// 可以用于接入新的 IO 类型，或者在测试中替换为注入故障的实现
+func RegisterIoManager(IoType FileIoType, factory IOManagerFactory) IOManagerFactory {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	prev := factories[IoType]
+	if factory == nil {
+		delete(factories, IoType)
+	} else {
+		factories[IoType] = factory
+	}
+	return prev
+}
+
+// IoManagerFactory 返回 IoType 当前注册的实现，没有注册时返回 nil
+func IoManagerFactory(IoType FileIoType) IOManagerFactory {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	return factories[IoType]
+}
+
+// 初始化IOManager，使用 IoType 注册的实现
+func NewIoManager(fileName string, IoType FileIoType) (IOManager, error) {
+	factory := IoManagerFactory(IoType)
+	if factory == nil {
+		return nil, ErrUnsupportedIoType
 	}
+	return factory(fileName)
 }
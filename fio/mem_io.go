@@ -0,0 +1,112 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrMemFileClosed = errors.New("memory file is closed")
+
+// 内存文件按照文件名保存，关闭之后重新打开仍然可以读取到之前写入的数据
+var memFiles = struct {
+	sync.Mutex
+	files map[string]*memFile
+}{files: make(map[string]*memFile)}
+
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// MemIO 纯内存的IO，数据不会写入磁盘，适用于测试和临时缓存
+type MemIO struct {
+	file   *memFile
+	closed bool
+}
+
+// NewMemIOManager 打开内存文件，文件不存在时创建
+func NewMemIOManager(fileName string) (*MemIO, error) {
+	memFiles.Lock()
+	defer memFiles.Unlock()
+	file, ok := memFiles.files[fileName]
+	if !ok {
+		file = &memFile{}
+		memFiles.files[fileName] = file
+	}
+	return &MemIO{file: file}, nil
+}
+
+// RemoveMemFile 删除内存文件，已经打开的 MemIO 仍然可以访问原来的数据
+func RemoveMemFile(fileName string) {
+	memFiles.Lock()
+	defer memFiles.Unlock()
+	delete(memFiles.files, fileName)
+}
+
+// Read从文件指定位置读取对应的数据
+func (mio *MemIO) Read(b []byte, offset int64) (int, error) {
+	if mio.closed {
+		return 0, ErrMemFileClosed
+	}
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	if offset >= int64(len(mio.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mio.file.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write写入字符数组到文件末尾
+func (mio *MemIO) Write(b []byte) (int, error) {
+	if mio.closed {
+		return 0, ErrMemFileClosed
+	}
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	mio.file.data = append(mio.file.data, b...)
+	return len(b), nil
+}
+
+// Sync数据只保存在内存中，不需要持久化
+func (mio *MemIO) Sync() error {
+	if mio.closed {
+		return ErrMemFileClosed
+	}
+	return nil
+}
+
+// Close关闭文件，数据仍然保留
+func (mio *MemIO) Close() error {
+	mio.closed = true
+	return nil
+}
+
+// Size获取文件大小
+func (mio *MemIO) Size() (int64, error) {
+	if mio.closed {
+		return 0, ErrMemFileClosed
+	}
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	return int64(len(mio.file.data)), nil
+}
+
+// Truncate截断文件
+func (mio *MemIO) Truncate(size int64) error {
+	if mio.closed {
+		return ErrMemFileClosed
+	}
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	if size < int64(len(mio.file.data)) {
+		mio.file.data = mio.file.data[:size]
+	} else {
+		mio.file.data = append(mio.file.data, make([]byte, size-int64(len(mio.file.data)))...)
+	}
+	return nil
+}
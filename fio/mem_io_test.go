@@ -0,0 +1,60 @@
+package fio
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemIO(t *testing.T) {
+	name := "mem-a.data"
+	defer RemoveMemFile(name)
+
+	mio, err := NewIoManager(name, MemoryIo)
+	assert.Nil(t, err)
+	n, err := mio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	_, _ = mio.Write([]byte("key-b"))
+
+	b := make([]byte, 5)
+	_, err = mio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+	_, err = mio.Read(b, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, mio.Close())
+	_, err = mio.Write([]byte("x"))
+	assert.Equal(t, ErrMemFileClosed, err)
+
+	//重新打开之后数据仍然存在
+	mio2, err := NewMemIOManager(name)
+	assert.Nil(t, err)
+	size, _ := mio2.Size()
+	assert.Equal(t, int64(10), size)
+	assert.Nil(t, mio2.Truncate(3))
+	_, _ = mio2.Write([]byte("b"))
+	b = make([]byte, 4)
+	_, err = mio2.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("keyb"), b)
+
+	RemoveMemFile(name)
+	mio3, _ := NewMemIOManager(name)
+	size, _ = mio3.Size()
+	assert.Equal(t, int64(0), size)
+}
+
+func TestRegisterIoManager(t *testing.T) {
+	_, err := NewIoManager("a.data", FileIoType(100))
+	assert.Equal(t, ErrUnsupportedIoType, err)
+
+	prev := RegisterIoManager(FileIoType(100), IoManagerFactory(MemoryIo))
+	assert.Nil(t, prev)
+	defer RegisterIoManager(FileIoType(100), nil)
+	mio, err := NewIoManager("mem-b.data", FileIoType(100))
+	defer RemoveMemFile("mem-b.data")
+	assert.Nil(t, err)
+	assert.IsType(t, &MemIO{}, mio)
+}
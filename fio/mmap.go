@@ -1,31 +1,57 @@
+//go:build unix
+
 package fio
 
 import (
+	"io"
 	"os"
 
-	"golang.org/x/exp/mmap"
+	"golang.org/x/sys/unix"
 )
 
 // MMap Io 内存文件映射
 type MMap struct {
-	readerAt *mmap.ReaderAt
+	data []byte
 }
 
 func NewMMapIOManger(fileName string) (*MMap, error) {
-	_, err := os.OpenFile(fileName, os.O_CREATE, DataFileperm)
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDONLY, DataFileperm)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
 	if err != nil {
 		return nil, err
 	}
-	readerAt, err := mmap.Open(fileName)
+	if stat.Size() == 0 {
+		return &MMap{}, nil
+	}
+	data, err := unix.Mmap(int(fd.Fd()), 0, int(stat.Size()), unix.PROT_READ, unix.MAP_SHARED)
 	if err != nil {
 		return nil, err
 	}
-	return &MMap{readerAt: readerAt}, nil
+	return &MMap{data: data}, nil
 }
 
 // Read从文件指定位置读取对应的数据
 func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
-	return mmap.readerAt.ReadAt(b, offset)
+	if offset >= int64(len(mmap.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mmap.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Bytes 直接返回映射区域中的数据，文件关闭之后不能再访问
+func (mmap *MMap) Bytes(n int64, offset int64) ([]byte, error) {
+	if offset+n > int64(len(mmap.data)) {
+		return nil, io.EOF
+	}
+	return mmap.data[offset : offset+n : offset+n], nil
 }
 
 // Write写入字符数组到文件中
@@ -41,11 +67,15 @@ func (mmap *MMap) Sync() error {
 
 // Close关闭文件
 func (mmap *MMap) Close() error {
-	return mmap.readerAt.Close()
-
+	if mmap.data == nil {
+		return nil
+	}
+	data := mmap.data
+	mmap.data = nil
+	return unix.Munmap(data)
 }
 
 // Size获取文件大小
 func (mmap *MMap) Size() (int64, error) {
-	return int64(mmap.readerAt.Len()), nil
+	return int64(len(mmap.data)), nil
 }
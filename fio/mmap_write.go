@@ -0,0 +1,143 @@
+//go:build unix
+
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrMMapSealed = errors.New("mmap file has been sealed,no more writes")
+
+// MMapWriter 可写的内存文件映射，文件预先扩展到 capacity，写入直接拷贝到映射区域
+// Size 返回已经写入的数据长度，Seal 和 Close 时将文件截断到该长度
+type MMapWriter struct {
+	mu     sync.RWMutex
+	fd     *os.File
+	data   []byte
+	size   int64 //已经写入的数据长度
+	sealed bool
+}
+
+// NewMMapWriteIOManager 打开可写的内存映射，size 为文件中已有数据的长度
+func NewMMapWriteIOManager(fileName string, size, capacity int64) (*MMapWriter, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFileperm)
+	if err != nil {
+		return nil, err
+	}
+	mw := &MMapWriter{fd: fd, size: size}
+	if err := mw.remap(max(capacity, size)); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return mw, nil
+}
+
+// 扩展文件并重新映射（在访问此方法前必须持有写锁）
+// 新的映射建立之后才解除旧的映射，失败时旧的映射保持可用
+func (mw *MMapWriter) remap(capacity int64) error {
+	if err := mw.fd.Truncate(capacity); err != nil {
+		return err
+	}
+	if capacity == 0 {
+		return nil
+	}
+	data, err := unix.Mmap(int(mw.fd.Fd()), 0, int(capacity), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	old := mw.data
+	mw.data = data
+	if old != nil {
+		return unix.Munmap(old)
+	}
+	return nil
+}
+
+// Read从文件指定位置读取对应的数据
+func (mw *MMapWriter) Read(b []byte, offset int64) (int, error) {
+	mw.mu.RLock()
+	defer mw.mu.RUnlock()
+	if offset >= mw.size {
+		return 0, io.EOF
+	}
+	n := copy(b, mw.data[offset:mw.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write写入字符数组到文件中，空间不足时扩展为原来的两倍
+func (mw *MMapWriter) Write(b []byte) (int, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.sealed {
+		return 0, ErrMMapSealed
+	}
+	if need := mw.size + int64(len(b)); need > int64(len(mw.data)) {
+		if err := mw.remap(max(need, int64(len(mw.data))*2)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(mw.data[mw.size:], b)
+	mw.size += int64(n)
+	return n, nil
+}
+
+// Sync持久化数据
+func (mw *MMapWriter) Sync() error {
+	mw.mu.RLock()
+	defer mw.mu.RUnlock()
+	if mw.size == 0 {
+		return nil
+	}
+	return unix.Msync(mw.data[:mw.size], unix.MS_SYNC)
+}
+
+// Seal 持久化数据并截断文件中预留的空间，之后只能读取
+// 映射区域保持不变，已经写入的数据仍然可以通过映射读取
+func (mw *MMapWriter) Seal() error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.sealed {
+		return nil
+	}
+	if mw.size > 0 {
+		if err := unix.Msync(mw.data[:mw.size], unix.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	if err := mw.fd.Truncate(mw.size); err != nil {
+		return err
+	}
+	mw.sealed = true
+	return nil
+}
+
+// Close关闭文件，文件截断到实际写入的长度
+func (mw *MMapWriter) Close() error {
+	if err := mw.Seal(); err != nil {
+		return err
+	}
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.data != nil {
+		if err := unix.Munmap(mw.data); err != nil {
+			return err
+		}
+		mw.data = nil
+	}
+	return mw.fd.Close()
+}
+
+// Size获取文件大小
+func (mw *MMapWriter) Size() (int64, error) {
+	mw.mu.RLock()
+	defer mw.mu.RUnlock()
+	return mw.size, nil
+}
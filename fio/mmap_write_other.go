@@ -0,0 +1,20 @@
+//go:build !unix
+
+package fio
+
+import "errors"
+
+var ErrMMapSealed = errors.New("mmap file has been sealed,no more writes")
+
+// MMapWriter 当前平台不支持可写的内存文件映射
+type MMapWriter struct {
+	FileIO
+}
+
+func NewMMapWriteIOManager(fileName string, size, capacity int64) (*MMapWriter, error) {
+	return nil, errors.New("writable mmap is not supported on this platform")
+}
+
+func (mw *MMapWriter) Seal() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+//go:build unix
+
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestMMapWriter_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w.data")
+	defer destoryFile(path)
+
+	mw, err := NewMMapWriteIOManager(path, 0, 16)
+	assert.Nil(t, err)
+
+	//文件预先扩展到 capacity
+	info, _ := os.Stat(path)
+	assert.Equal(t, int64(16), info.Size())
+
+	n, err := mw.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	//超过预留的空间时扩展
+	_, err = mw.Write([]byte("value-value-value"))
+	assert.Nil(t, err)
+	size, _ := mw.Size()
+	assert.Equal(t, int64(22), size)
+	assert.Nil(t, mw.Sync())
+
+	b := make([]byte, 5)
+	n, err = mw.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), b[:n])
+	//不能读到已写入的数据之后
+	n, err = mw.Read(b, 20)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, n)
+
+	//Seal 之后截断文件，仍然可以读取
+	assert.Nil(t, mw.Seal())
+	info, _ = os.Stat(path)
+	assert.Equal(t, int64(22), info.Size())
+	_, err = mw.Write([]byte("a"))
+	assert.Equal(t, ErrMMapSealed, err)
+	n, err = mw.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b[:n])
+	assert.Nil(t, mw.Close())
+}
+
+func TestMMapWriter_Reopen(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w.data")
+	defer destoryFile(path)
+
+	fio, err := NewFileIOManger(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("aabb"))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Close())
+
+	//从已有数据之后继续写入
+	mw, err := NewMMapWriteIOManager(path, 4, 1024)
+	assert.Nil(t, err)
+	_, err = mw.Write([]byte("cc"))
+	assert.Nil(t, err)
+	assert.Nil(t, mw.Close())
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aabbcc"), content)
+}
+
+// 扩展失败时原来的映射仍然可以读写
+func TestMMapWriter_RemapFailure(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-w.data")
+	defer destoryFile(path)
+
+	mw, err := NewMMapWriteIOManager(path, 0, 16)
+	assert.Nil(t, err)
+	_, err = mw.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	//关闭文件让扩展失败
+	assert.Nil(t, mw.fd.Close())
+	_, err = mw.Write(make([]byte, 32))
+	assert.NotNil(t, err)
+
+	b := make([]byte, 5)
+	n, err := mw.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b[:n])
+	_, err = mw.Write([]byte("value"))
+	assert.Nil(t, err)
+	n, err = mw.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), b[:n])
+	assert.Nil(t, unix.Munmap(mw.data))
+}
@@ -2,19 +2,23 @@ module bitcask
 
 go 1.21.4
 
+require (
+	github.com/gofrs/flock v0.8.1
+	github.com/google/btree v1.1.2
+	github.com/klauspost/compress v1.17.11
+	github.com/plar/go-adaptive-radix-tree v1.0.5
+	github.com/saint-yellow/baradb v0.1.1
+	github.com/stretchr/testify v1.8.4
+	github.com/tidwall/redcon v1.6.2
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/sys v0.8.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gofrs/flock v0.8.1 // indirect
-	github.com/google/btree v1.1.2 // indirect
-	github.com/plar/go-adaptive-radix-tree v1.0.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/saint-yellow/baradb v0.1.1 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/tidwall/btree v1.1.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
-	github.com/tidwall/redcon v1.6.2 // indirect
-	go.etcd.io/bbolt v1.3.8 // indirect
 	golang.org/x/exp v0.0.0-20231214170342-aacd6d4b4611 // indirect
-	golang.org/x/sys v0.8.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
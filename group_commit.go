@@ -0,0 +1,114 @@
+package bitcaskkvdb
+
+import "bitcask/data"
+
+/*
+	组提交：并发的写请求先进入队列，抢到写入令牌的请求成为写入者，
+	一次性追加队列中所有请求的数据，只做一次 Sync，然后唤醒所有等待者。
+	持久化期间到达的请求会在下一组中一起提交。
+*/
+
+// 一次写请求，请求中的数据会被连续地追加到数据文件中
+type commitRequest struct {
+	records []*data.LogRecord //需要写入的数据
+
+	//在持有 db.mu 时生成需要写入的数据，返回错误则放弃本次请求
+	prepare func() ([]*data.LogRecord, error)
+
+	//数据持久化之后，在持有 db.mu 时调用，用于更新内存索引
+	apply func(positions []*data.LogRecordPos)
+
+	sync      bool                 //本次请求是否要求持久化
+	positions []*data.LogRecordPos //写入之后每条数据的位置
+	err       error
+	done      chan struct{}
+}
+
+// commit 提交写请求，等待请求所在的组写入完成
+func (db *DB) commit(req *commitRequest) error {
+	req.done = make(chan struct{})
+	db.commitMu.Lock()
+	db.commitQueue = append(db.commitQueue, req)
+	db.commitMu.Unlock()
+
+	select {
+	case <-req.done:
+		return req.err
+	case db.commitToken <- struct{}{}:
+	}
+
+	//拿到令牌时请求可能已经被上一个写入者处理
+	select {
+	case <-req.done:
+		<-db.commitToken
+		return req.err
+	default:
+	}
+
+	db.commitMu.Lock()
+	group := db.commitQueue
+	db.commitQueue = nil
+	db.commitMu.Unlock()
+
+	db.writeGroup(group)
+	<-db.commitToken
+	return req.err
+}
+
+// 追加一组请求的数据，只做一次持久化，然后唤醒组内所有请求
+func (db *DB) writeGroup(group []*commitRequest) {
+	defer func() {
+		for _, req := range group {
+			close(req.done)
+		}
+	}()
+
+	db.mu.Lock()
+	var needSync bool
+	written := make([]*commitRequest, 0, len(group))
+	for _, req := range group {
+		records := req.records
+		if req.prepare != nil {
+			if records, req.err = req.prepare(); req.err != nil {
+				continue
+			}
+		}
+		req.positions = make([]*data.LogRecordPos, 0, len(records))
+		for _, record := range records {
+			pos, err := db.writeLogRecord(record)
+			if err != nil {
+				req.err = err
+				break
+			}
+			req.positions = append(req.positions, pos)
+		}
+		if req.err == nil {
+			written = append(written, req)
+			needSync = needSync || req.sync
+		}
+	}
+	needSync = needSync || db.needSync()
+	activefile := db.activefile
+	db.mu.Unlock()
+
+	//持久化期间不持有锁，读请求和新的请求入队不受影响
+	if needSync && activefile != nil && len(written) > 0 {
+		if err := activefile.Sync(); err != nil {
+			for _, req := range written {
+				req.err = err
+			}
+			return
+		}
+	}
+
+	db.mu.Lock()
+	if needSync {
+		db.bytesWrite = 0
+	}
+	for _, req := range written {
+		if req.apply != nil {
+			req.apply(req.positions)
+		}
+	}
+	db.mu.Unlock()
+}
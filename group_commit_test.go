@@ -0,0 +1,193 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/utils"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	//并发的 Put、Delete 和 WriteBatch 共同参与组提交
+	var wg sync.WaitGroup
+	wg.Add(20)
+	for j := 0; j < 10; j++ {
+		start := j * 1000
+		go func() {
+			defer wg.Done()
+			for i := start; i < start+1000; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+			}
+			for i := start; i < start+500; i++ {
+				assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := start; i < start+1000; i += 10 {
+				wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+				for k := i; k < i+10; k++ {
+					assert.Nil(t, wb.Put(utils.GetTestKey(100000+k), utils.GetTestKey(k)))
+				}
+				assert.Nil(t, wb.Commit())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 0, len(db.commitQueue))
+
+	check := func(db *DB) {
+		assert.Equal(t, 15000, len(db.ListKeys()))
+		for i := 0; i < 10000; i++ {
+			val, err := db.Get(utils.GetTestKey(100000 + i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+			_, err = db.Get(utils.GetTestKey(i))
+			if i%1000 < 500 {
+				assert.Equal(t, ErrKeyNotFind, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+	}
+	check(db)
+
+	//重启之后数据依然完整
+	db.Close()
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+}
+
+// 并发写入同一个 key，索引中保存的必须是最后写入数据文件的版本
+// 关闭 SyncWrites 时普通写入不经过组提交，和需要持久化的批量写入交错执行
+func TestDB_GroupCommitSameKey(t *testing.T) {
+	for _, syncWrites := range []bool{true, false} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.SyncWrites = syncWrites
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		//每一轮同时启动多个协程写入同一个 key
+		const keys = 500
+		for i := 0; i < keys; i++ {
+			key := utils.GetTestKey(i)
+			var wg sync.WaitGroup
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					value := []byte(fmt.Sprintf("%d-%d", g, i))
+					if g == 0 {
+						wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+						assert.Nil(t, wb.Put(key, value))
+						assert.Nil(t, wb.Commit())
+						return
+					}
+					assert.Nil(t, db.Put(key, value))
+				}(g)
+			}
+			wg.Wait()
+		}
+
+		current := make([][]byte, keys)
+		for i := 0; i < keys; i++ {
+			current[i], err = db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+
+		//重启时按照数据文件的顺序重建索引，结果必须和重启之前一致
+		assert.Nil(t, db.Close())
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < keys; i++ {
+			val, err := db2.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, current[i], val)
+		}
+		assert.Nil(t, db2.Close())
+		destroyDB(db2)
+	}
+}
+
+// 同一组中先写入的 Put、Delete 必须让后面读过该 key 的事务提交失败
+func TestDB_GroupCommitConflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//等待提交队列中有 n 个请求
+	waitQueued := func(n int) {
+		for {
+			db.commitMu.Lock()
+			queued := len(db.commitQueue)
+			db.commitMu.Unlock()
+			if queued >= n {
+				return
+			}
+			runtime.Gosched()
+		}
+	}
+
+	for _, del := range []bool{false, true} {
+		key := utils.GetTestKey(1)
+		assert.Nil(t, db.Put(key, []byte("base")))
+		txn := db.Begin()
+		_, err := txn.Get(key)
+		assert.Nil(t, err)
+		assert.Nil(t, txn.Put(key, []byte("txn")))
+
+		//占住写入令牌，让非事务写入和事务提交按顺序进入同一组
+		db.commitToken <- struct{}{}
+		var writeErr, commitErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if del {
+				writeErr = db.Delete(key)
+			} else {
+				writeErr = db.Put(key, []byte("put"))
+			}
+		}()
+		waitQueued(1)
+		go func() {
+			defer wg.Done()
+			commitErr = txn.Commit()
+		}()
+		waitQueued(2)
+		<-db.commitToken
+		wg.Wait()
+
+		assert.Nil(t, writeErr)
+		assert.Equal(t, ErrTxnConflict, commitErr)
+		val, err := db.Get(key)
+		if del {
+			assert.Equal(t, ErrKeyNotFind, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("put"), val)
+		}
+	}
+}
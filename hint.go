@@ -0,0 +1,147 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 数据文件 Hint 中的一条记录，对应数据文件中的一条数据
+type hintEntry struct {
+	key []byte //包含事务序列号的 Key
+	typ data.LogRecordType
+	pos *data.LogRecordPos
+}
+
+// 封存的数据文件在后台生成 Hint 文件，启动时读取 Hint 文件而不需要扫描整个数据文件
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) writeHintFileAsync(dataFile *data.DataFile) {
+	//B+树索引启动时不需要加载数据文件
+	if db.options.IndexType == BPlusTree {
+		return
+	}
+	dataFile.Ref()
+	db.hintWg.Add(1)
+	go func() {
+		defer db.hintWg.Done()
+		defer dataFile.Unref()
+		_ = writeHintFile(db.options.Dirpath, dataFile, db.options.EncryptionKeys)
+	}()
+}
+
+// 扫描数据文件生成 Hint 文件，数据文件损坏时不生成，启动时仍然扫描数据文件
+func writeHintFile(dirpath string, dataFile *data.DataFile, keys data.KeyProvider) (err error) {
+	//之前生成时被中断的 Hint 文件没有结束标记，重新生成
+	if err := removeHintFile(dirpath, dataFile.FileId); err != nil {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(dirpath, dataFile.FileId, keys)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := hintFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = removeHintFile(dirpath, dataFile.FileId)
+		}
+	}()
+
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	var offset = dataFile.DataOffset()
+	for offset < fileSize {
+		logRecord, size, err := dataFile.ReadRecord(offset)
+		if err != nil {
+			return err
+		}
+		pos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size), ExpireAt: logRecord.ExpireAt}
+		if err := hintFile.WriteHintEntry(logRecord.Key, logRecord.Type, pos); err != nil {
+			return err
+		}
+		offset += size
+	}
+	if err := hintFile.WriteHintEnd(fileSize); err != nil {
+		return err
+	}
+	return hintFile.Sync()
+}
+
+// 读取数据文件对应的 Hint 文件
+// Hint 文件不存在、不完整或者和数据文件的长度不一致时返回 false，此时需要扫描数据文件
+func (db *DB) loadHintEntries(dataFile *data.DataFile, fileSize int64) ([]*hintEntry, bool) {
+	hintFileName := data.GetHintFileName(db.options.Dirpath, dataFile.FileId)
+	if _, err := os.Stat(hintFileName); err != nil {
+		return nil, false
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.Dirpath, dataFile.FileId, db.options.EncryptionKeys)
+	if err != nil {
+		return nil, false
+	}
+	defer hintFile.Close()
+
+	var entries []*hintEntry
+	var offset = hintFile.DataOffset()
+	for {
+		logRecord, size, err := hintFile.ReadRecord(offset)
+		if err != nil {
+			//读到文件末尾时还没有结束标记
+			return nil, false
+		}
+		offset += size
+		if dataSize, ok := data.DecodeHintEnd(logRecord); ok {
+			if dataSize != fileSize {
+				return nil, false
+			}
+			break
+		}
+		entries = append(entries, &hintEntry{
+			key: logRecord.Key,
+			typ: logRecord.Type,
+			pos: data.DecodeLogRecordPos(logRecord.Value),
+		})
+	}
+	//结束标记之后不应该有其他数据
+	if _, _, err := hintFile.ReadRecord(offset); err != io.EOF {
+		return nil, false
+	}
+	return entries, true
+}
+
+// 删除数据文件对应的 Hint 文件
+func removeHintFile(dirpath string, fileId uint32) error {
+	if err := os.Remove(data.GetHintFileName(dirpath, fileId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 删除没有对应数据文件的 Hint 文件，数据文件被 Merge 删除时 Hint 文件可能还在生成
+func (db *DB) removeOrphanHintFiles() error {
+	dirEntries, err := os.ReadDir(db.options.Dirpath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, data.HintFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(name, data.HintFileNameSuffix))
+		if err != nil {
+			continue
+		}
+		if _, ok := db.olderfile[uint32(fileId)]; ok {
+			continue
+		}
+		if err := removeHintFile(db.options.Dirpath, uint32(fileId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_DataFileHint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		key, value := utils.GetTestKey(i%150), utils.RandomValue(32)
+		assert.Nil(t, db.Put(key, value))
+		expected[string(key)] = value
+	}
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("ttl"), []byte("value"), time.Hour))
+	expected["ttl"] = []byte("value")
+	//跨越多个数据文件的批次
+	wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+	for i := 150; i < 400; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(32)
+		assert.Nil(t, wb.Put(key, value))
+		expected[string(key)] = value
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	//每个旧文件都有 Hint 文件，活跃文件没有
+	assert.Greater(t, len(db.olderfile), 3)
+	for fid := range db.olderfile {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetHintFileName(dir, db.activefile.FileId))
+	assert.True(t, os.IsNotExist(err))
+
+	check := func(db *DB) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+	}
+
+	//从 Hint 文件加载的结果和扫描数据文件相同
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	stat := db2.Stat()
+	assert.Nil(t, db2.Close())
+
+	//不完整的 Hint 文件和被删除的 Hint 文件在启动后重新生成
+	hintName := data.GetHintFileName(dir, 1)
+	content, err := os.ReadFile(hintName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(hintName, content[:len(content)/2], 0644))
+	assert.Nil(t, os.Remove(data.GetHintFileName(dir, 2)))
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	check(db3)
+	stat3 := db3.Stat()
+	assert.Equal(t, stat.KeyNum, stat3.KeyNum)
+	assert.Equal(t, stat.DeletedSize, stat3.DeletedSize)
+	assert.Equal(t, stat.Files, stat3.Files)
+	assert.Nil(t, db3.Close())
+	regenerated, err := os.ReadFile(hintName)
+	assert.Nil(t, err)
+	assert.Equal(t, len(content), len(regenerated))
+	_, err = os.Stat(data.GetHintFileName(dir, 2))
+	assert.Nil(t, err)
+
+	//旧文件从 Hint 加载，启动时不扫描数据文件，损坏的数据在读取时才会发现
+	fileName := data.GetDataFileName(dir, 0)
+	content, err = os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[len(content)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	opts.RecoveryMode = RecoverStrict
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db4.RecoveryReport().Corruptions))
+	assert.Nil(t, db4.Close())
+
+	//Merge 之后旧文件的 Hint 文件一起删除
+	opts.RecoveryMode = RecoverTruncateTail
+	content[len(content)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	db5, err := Open(opts)
+	defer destroyDB(db5)
+	assert.Nil(t, err)
+	mergedIds := make([]uint32, 0, len(db5.olderfile))
+	for fid := range db5.olderfile {
+		mergedIds = append(mergedIds, fid)
+	}
+	db5.options.DataFileMergeRatio = 0
+	assert.Nil(t, db5.Merge())
+	assert.Nil(t, db5.Close())
+	for _, fid := range mergedIds {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	db6, err := Open(opts)
+	defer destroyDB(db6)
+	assert.Nil(t, err)
+	check(db6)
+}
+
+// 等待 Hint 文件生成的 Stat 和 BackUp 不阻塞写入
+func TestDB_StatWhileWritingHint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(10)))
+
+	//模拟一个正在生成的 Hint 文件，测试失败时也要结束，否则 destroyDB 会一直等待
+	db.hintWg.Add(1)
+	var hintOnce sync.Once
+	hintDone := func() { hintOnce.Do(db.hintWg.Done) }
+	defer hintDone()
+	statDone := make(chan *Stat)
+	go func() {
+		statDone <- db.Stat()
+	}()
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup")
+	defer os.RemoveAll(backupDir)
+	backupDone := make(chan error)
+	go func() {
+		backupDone <- db.BackUp(backupDir)
+	}()
+
+	//等待 Stat 和 BackUp 开始等待 Hint 文件
+	time.Sleep(100 * time.Millisecond)
+	putDone := make(chan error)
+	go func() {
+		putDone <- db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	}()
+	select {
+	case err := <-putDone:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write is blocked by Stat waiting for hint files")
+	}
+
+	hintDone()
+	assert.Equal(t, uint(2), (<-statDone).KeyNum)
+	assert.Nil(t, <-backupDone)
+}
@@ -4,7 +4,6 @@ import (
 	"bitcask/data"
 	"bytes"
 	"container/heap"
-	"sort"
 	"sync"
 
 	goart "github.com/plar/go-adaptive-radix-tree"
@@ -14,11 +13,21 @@ import (
 type AdaptiveRadixTree struct {
 	tree     []goart.Tree
 	lock     []*sync.RWMutex
+	hash     HashFunc //选择分片的哈希函数
 	IndexNum int64
 }
 
 func NewART(num int64) *AdaptiveRadixTree {
+	return NewARTWithHash(num, nil)
+}
+
+// NewARTWithHash 使用指定的分片哈希函数创建索引，hash 为空时使用 FNV-1a
+func NewARTWithHash(num int64, hash HashFunc) *AdaptiveRadixTree {
+	if hash == nil {
+		hash = FNV1aHash
+	}
 	art := &AdaptiveRadixTree{
+		hash:     hash,
 		IndexNum: num,
 	}
 
@@ -32,9 +41,14 @@ func NewART(num int64) *AdaptiveRadixTree {
 	return art
 }
 
+// key 所在的分片
+func (art *AdaptiveRadixTree) shard(key []byte) int {
+	return int(art.hash(key) % uint64(art.IndexNum))
+}
+
 // 向内存索引中存储key对应的数据位置信息
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	index := Hash(key, art.IndexNum)
+	index := art.shard(key)
 	art.lock[index].Lock()
 	old, _ := art.tree[index].Insert(key, pos)
 	art.lock[index].Unlock()
@@ -46,7 +60,7 @@ func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogR
 
 // 根据key值取出内存中对应的索引位置信息
 func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
-	index := Hash(key, art.IndexNum)
+	index := art.shard(key)
 	art.lock[index].RLock()
 	defer art.lock[index].RUnlock()
 	value, found := art.tree[index].Search(key)
@@ -58,7 +72,7 @@ func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 
 // 根据key值删除对应的索引位置信息
 func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	index := Hash(key, art.IndexNum)
+	index := art.shard(key)
 	art.lock[index].Lock()
 	old, deleted := art.tree[index].Delete(key)
 	art.lock[index].Unlock()
@@ -79,183 +93,264 @@ func (art *AdaptiveRadixTree) Size() int {
 	return size
 }
 
+// 每个分片中的key数量
+func (art *AdaptiveRadixTree) ShardSizes() []int {
+	sizes := make([]int, art.IndexNum)
+	for i := 0; i < int(art.IndexNum); i++ {
+		art.lock[i].RLock()
+		sizes[i] = art.tree[i].Size()
+		art.lock[i].RUnlock()
+	}
+	return sizes
+}
+
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
 
-// 索引迭代器
+// 索引迭代器，按需从每个分片中读取数据，不复制整个索引
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock[0].RLock()
-	defer art.lock[0].RUnlock()
-	return NewArtIterator(art.tree, reverse)
+	return NewArtIterator(art, reverse)
 }
 
-// Art 索引迭代器
-type artIterator struct {
-	curIndex int     //当前位置
-	reverse  bool    //是否是反向遍历
-	values   []*Item //key+LogRecordPos
-}
-
-func NewArtIterator(tree []goart.Tree, reverse bool) *artIterator {
-	n := len(tree)
-	values := make([][]*Item, n)
-	for i := 0; i < n; i++ {
-		size := tree[i].Size()
-		values[i] = make([]*Item, size)
-		var idx int
-		//将所有数据存放在数组中
-		saveValues := func(node goart.Node) bool {
-			Item := &Item{
-				key: node.Key(),
-				pos: node.Value().(*data.LogRecordPos),
+// 迭代器每次从一个分片中读取的数据个数
+const artIteratorPageSize = 128
+
+// 一个分片上的游标，持有分片读锁分批读取数据，两次读取之间分片可以被修改
+type artCursor struct {
+	tree  goart.Tree
+	lock  *sync.RWMutex
+	page  []*Item //当前批次的数据，按照遍历顺序排列
+	index int     //当前位置
+	done  bool    //当前批次之后没有更多的数据
+}
+
+// 读取 key 之后（反向遍历时为之前）的一批数据，key 为 nil 时从头读取
+func (c *artCursor) load(key []byte, inclusive, reverse bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if reverse {
+		c.page = descendTree(c.tree, key, inclusive, artIteratorPageSize)
+	} else {
+		c.page = ascendTree(c.tree, key, inclusive, artIteratorPageSize)
+	}
+	c.index = 0
+	c.done = len(c.page) < artIteratorPageSize
+}
+
+func (c *artCursor) valid() bool {
+	return c.index < len(c.page)
+}
+
+func (c *artCursor) item() *Item {
+	return c.page[c.index]
+}
+
+func (c *artCursor) next(reverse bool) {
+	c.index++
+	if c.index < len(c.page) || c.done {
+		return
+	}
+	c.load(c.page[len(c.page)-1].key, false, reverse)
+}
+
+// 按照升序读取 > key（inclusive 时为 >=）的最多 n 个数据
+// 依次读取以 key 为前缀的数据，以及 key[:i] 之后的字节大于 key[i] 的子树，i 从大到小
+func ascendTree(tree goart.Tree, key []byte, inclusive bool, n int) []*Item {
+	items := make([]*Item, 0, n)
+	collect := func(prefix []byte) {
+		tree.ForEachPrefix(prefix, func(node goart.Node) bool {
+			if node.Kind() != goart.Leaf || !bytes.HasPrefix(node.Key(), prefix) {
+				return true
+			}
+			if !inclusive && bytes.Equal(node.Key(), key) {
+				return true
 			}
-			values[i][idx] = Item
-			idx++
+			items = append(items, &Item{key: node.Key(), pos: node.Value().(*data.LogRecordPos)})
+			return len(items) < n
+		})
+	}
+	//goart 不匹配 nil 前缀
+	collect(append([]byte{}, key...))
+	prefix := make([]byte, len(key))
+	for i := len(key) - 1; i >= 0 && len(items) < n; i-- {
+		copy(prefix, key[:i])
+		for b := int(key[i]) + 1; b <= 0xff && len(items) < n; b++ {
+			prefix[i] = byte(b)
+			collect(prefix[:i+1])
+		}
+	}
+	return items
+}
+
+// 按照降序读取 < key（inclusive 时为 <=）的最多 n 个数据，key 为 nil 时从最大的数据开始
+// 依次读取 key[:i] 之后的字节小于 key[i] 的子树，以及 key[:i] 本身，i 从大到小
+func descendTree(tree goart.Tree, key []byte, inclusive bool, n int) []*Item {
+	items := make([]*Item, 0, n)
+	if key == nil {
+		return descendPrefix(tree, []byte{}, items, n)
+	}
+	search := func(k []byte) {
+		if value, found := tree.Search(k); found {
+			items = append(items, &Item{key: append([]byte(nil), k...), pos: value.(*data.LogRecordPos)})
+		}
+	}
+	if inclusive {
+		search(key)
+	}
+	for i := len(key) - 1; i >= 0 && len(items) < n; i-- {
+		prefix := make([]byte, i+1)
+		copy(prefix, key[:i])
+		for b := int(key[i]) - 1; b >= 0 && len(items) < n; b-- {
+			prefix[i] = byte(b)
+			items = descendPrefix(tree, prefix, items, n)
+		}
+		if i > 0 && len(items) < n {
+			search(key[:i])
+		}
+	}
+	return items
+}
+
+// 按照降序追加以 prefix 为前缀的数据，直到 items 中有 n 个数据
+// goart 只支持升序遍历，数据较少的子树升序读取后翻转，数据较多的子树逐个字节向下查找
+func descendPrefix(tree goart.Tree, prefix []byte, items []*Item, n int) []*Item {
+	need := n - len(items)
+	var ascend []*Item
+	var overflow bool
+	tree.ForEachPrefix(prefix, func(node goart.Node) bool {
+		if node.Kind() != goart.Leaf || !bytes.HasPrefix(node.Key(), prefix) {
 			return true
 		}
-		tree[i].ForEach(saveValues)
+		if len(ascend) == need {
+			overflow = true
+			return false
+		}
+		ascend = append(ascend, &Item{key: node.Key(), pos: node.Value().(*data.LogRecordPos)})
+		return true
+	})
+	if !overflow {
+		for i := len(ascend) - 1; i >= 0; i-- {
+			items = append(items, ascend[i])
+		}
+		return items
 	}
 
-	output := MergeSortedArrays(values)
-	if reverse {
-		Reverse(output)
+	child := make([]byte, len(prefix)+1)
+	copy(child, prefix)
+	for b := 0xff; b >= 0 && len(items) < n; b-- {
+		child[len(prefix)] = byte(b)
+		items = descendPrefix(tree, child, items, n)
+	}
+	if len(prefix) > 0 && len(items) < n {
+		if value, found := tree.Search(prefix); found {
+			items = append(items, &Item{key: append([]byte(nil), prefix...), pos: value.(*data.LogRecordPos)})
+		}
+	}
+	return items
+}
+
+// Art 索引迭代器，对每个分片上的游标做多路归并
+type artIterator struct {
+	cursors []*artCursor
+	heap    cursorHeap //还有数据的游标，堆顶为当前位置
+}
+
+func NewArtIterator(art *AdaptiveRadixTree, reverse bool) *artIterator {
+	ai := &artIterator{
+		cursors: make([]*artCursor, len(art.tree)),
+		heap:    cursorHeap{reverse: reverse},
+	}
+	for i := range art.tree {
+		ai.cursors[i] = &artCursor{tree: art.tree[i], lock: art.lock[i]}
 	}
-	return &artIterator{
-		curIndex: 0,
-		reverse:  reverse,
-		values:   output,
+	ai.Rewind()
+	return ai
+}
+
+// 从 key 开始重新加载所有游标
+func (ai *artIterator) reset(key []byte) {
+	ai.heap.cursors = ai.heap.cursors[:0]
+	for _, c := range ai.cursors {
+		c.load(key, true, ai.heap.reverse)
+		if c.valid() {
+			ai.heap.cursors = append(ai.heap.cursors, c)
+		}
 	}
+	heap.Init(&ai.heap)
 }
 
 // 重新回到迭代器的起点，即第一个数据
 func (ai *artIterator) Rewind() {
-	ai.curIndex = 0
+	ai.reset(nil)
 }
 
 // 根据传入的key，跳转到>= 或（<=）key的第一个位置
 func (ai *artIterator) Seek(key []byte) {
-	if ai.reverse {
-		ai.curIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		ai.curIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
-	}
+	ai.reset(key)
 }
 
 // 跳转到下一个key
 func (ai *artIterator) Next() {
-	ai.curIndex++
+	c := ai.heap.cursors[0]
+	c.next(ai.heap.reverse)
+	if c.valid() {
+		heap.Fix(&ai.heap, 0)
+	} else {
+		heap.Pop(&ai.heap)
+	}
 }
 
 // 是否有效，是否已经遍历完所有的key，用于退出遍历
 func (ai *artIterator) Valid() bool {
-	return ai.curIndex >= 0 && ai.curIndex < len(ai.values)
+	return len(ai.heap.cursors) > 0
 }
 
 // 返回当前位置的Key
 func (ai *artIterator) Key() []byte {
-	return ai.values[ai.curIndex].key
+	return ai.heap.cursors[0].item().key
 }
 
 // 返回当前位置的Value数据
 func (ai *artIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.curIndex].pos
+	return ai.heap.cursors[0].item().pos
 }
 
 // 关闭迭代器，释放相应资源
 func (ai *artIterator) Close() {
-	ai.values = nil
-}
-
-// ItemArray is a slice of Items
-type heapItem struct {
-	item  *Item
-	index int
-}
-
-type ItemArray []heapItem
-
-// ItemHeap is a struct that implements heap.Interface
-type ItemHeap struct {
-	items []heapItem // the slice of items
-}
-
-// Len returns the length of the ItemHeap
-func (h ItemHeap) Len() int {
-	return len(h.items)
+	ai.cursors = nil
+	ai.heap.cursors = nil
 }
 
-// Less returns true if the item at i is smaller than the item at j
-func (h ItemHeap) Less(i, j int) bool {
-	return string(h.items[i].item.key) < string(h.items[j].item.key)
+// 按照每个游标当前的key排序的堆，反向遍历时为最大堆
+type cursorHeap struct {
+	cursors []*artCursor
+	reverse bool
 }
 
-// Swap swaps the items at i and j
-func (h ItemHeap) Swap(i, j int) {
-	h.items[i], h.items[j] = h.items[j], h.items[i]
+func (h cursorHeap) Len() int {
+	return len(h.cursors)
 }
 
-// Push adds an item to the ItemHeap
-func (h *ItemHeap) Push(x interface{}) {
-	item := x.(heapItem)
-	h.items = append(h.items, item)
+func (h cursorHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.cursors[i].item().key, h.cursors[j].item().key)
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
 }
 
-// Pop removes and returns the smallest item from the ItemHeap
-func (h *ItemHeap) Pop() interface{} {
-	n := len(h.items)
-	item := h.items[n-1]
-	h.items = h.items[:n-1]
-	return item
+func (h cursorHeap) Swap(i, j int) {
+	h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
 }
 
-// MergeSortedArrays merges n sorted ItemArrays into one sorted ItemArray
-func MergeSortedArrays(arrays [][]*Item) []*Item {
-	// initialize the output array
-	n := len(arrays) // the number of arrays
-	k := 0           // the maximum length of each array
-	for _, array := range arrays {
-		if len(array) > k {
-			k = len(array)
-		}
-	}
-	output := make([]*Item, 0, n*k)
-
-	// initialize the min heap
-	h := &ItemHeap{}
-	heap.Init(h)
-	for i, array := range arrays {
-		if len(array) > 0 {
-			// push the first item of each array to the heap
-			heap.Push(h, heapItem{array[0], i})
-		}
-	}
-
-	// repeat n*k times
-	for h.Len() > 0 {
-		// pop the smallest item from the heap
-		item := heap.Pop(h).(heapItem)
-		// append it to the output array
-		output = append(output, item.item)
-		// get the index of the array that the item belongs to
-		idx := item.index
-		// get the next item from the same array
-		arrays[idx] = arrays[idx][1:]
-		if len(arrays[idx]) > 0 {
-			// push the next item to the heap
-			heap.Push(h, heapItem{arrays[idx][0], idx})
-		}
-	}
-	// return the output array
-	return output
+func (h *cursorHeap) Push(x interface{}) {
+	h.cursors = append(h.cursors, x.(*artCursor))
 }
 
-func Reverse(s []*Item) {
-	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
-		s[i], s[j] = s[j], s[i]
-	}
+func (h *cursorHeap) Pop() interface{} {
+	n := len(h.cursors)
+	c := h.cursors[n-1]
+	h.cursors = h.cursors[:n-1]
+	return c
 }
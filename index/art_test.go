@@ -3,8 +3,14 @@ package index
 import (
 	"bitcask/data"
 	"bitcask/utils"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
 	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestArt(t *testing.T) {
@@ -99,3 +105,151 @@ func TestMultiIterate(t *testing.T) {
 	iter.Next()
 	t.Log(string(iter.Key()))
 }
+
+func TestArt_IteratorSeek(t *testing.T) {
+	art := NewART(4)
+	bt := NewBtree()
+	//包含互为前缀、含有 0 字节和 0xff 字节的key，数据量超过一批
+	rand := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		key := make([]byte, 1+rand.Intn(5))
+		for j := range key {
+			key[j] = []byte{0x00, 0x01, 'a', 'b', 0xfe, 0xff}[rand.Intn(6)]
+		}
+		pos := &data.LogRecordPos{Fid: uint32(i)}
+		art.Put(key, pos)
+		bt.Put(key, pos)
+	}
+	assert.Equal(t, bt.Size(), art.Size())
+
+	check := func(reverse bool, seek []byte) {
+		expected := bt.Iterator(reverse)
+		iter := art.Iterator(reverse)
+		if seek == nil {
+			expected.Rewind()
+			iter.Rewind()
+		} else {
+			expected.Seek(seek)
+			iter.Seek(seek)
+		}
+		for ; expected.Valid(); expected.Next() {
+			assert.True(t, iter.Valid())
+			assert.Equal(t, expected.Key(), iter.Key())
+			assert.Equal(t, expected.Value(), iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.Valid())
+		iter.Close()
+	}
+	for _, reverse := range []bool{false, true} {
+		check(reverse, nil)
+		check(reverse, []byte{})
+		for i := 0; i < 200; i++ {
+			seek := make([]byte, rand.Intn(6))
+			for j := range seek {
+				seek[j] = []byte{0x00, 0x01, 'a', 'b', 'c', 0xfe, 0xff}[rand.Intn(7)]
+			}
+			check(reverse, seek)
+		}
+	}
+}
+
+func TestArt_IteratorConcurrentModify(t *testing.T) {
+	art := NewART(10)
+	for i := 0; i < 2000; i++ {
+		art.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: uint32(i)})
+	}
+
+	//遍历期间修改索引，没有被修改的key仍然按顺序各出现一次
+	for _, reverse := range []bool{false, true} {
+		iter := art.Iterator(reverse)
+		var prev []byte
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if prev != nil {
+				if reverse {
+					assert.Less(t, string(key), string(prev))
+				} else {
+					assert.Greater(t, string(key), string(prev))
+				}
+			}
+			prev = key
+			count++
+			key = utils.GetTestKey(count * 7 % 2000)
+			art.Delete(key)
+			art.Put(key, &data.LogRecordPos{Fid: uint32(count)})
+			extra := []byte(fmt.Sprintf("bitcask-go-key-%09d-extra", count))
+			art.Put(extra, &data.LogRecordPos{})
+			art.Delete(extra)
+		}
+		assert.Equal(t, 2000, count)
+	}
+}
+
+func TestArt_IteratorAllocs(t *testing.T) {
+	art := NewART(10)
+	for i := 0; i < 100000; i++ {
+		art.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: uint32(i)})
+	}
+
+	//前缀遍历只读取需要的数据，不复制整个索引
+	prefix := []byte("bitcask-go-key-0000123")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	iter := art.Iterator(false)
+	var count int
+	for iter.Seek(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+		count++
+	}
+	iter.Close()
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, 100, count)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestArt_ShardDistribution(t *testing.T) {
+	//共享长前缀的key、字节相同顺序不同的key
+	keySets := map[string][][]byte{}
+	for i := 0; i < 20000; i++ {
+		keySets["test"] = append(keySets["test"], utils.GetTestKey(i))
+		keySets["user"] = append(keySets["user"], []byte(fmt.Sprintf("user:%08d:profile", i)))
+	}
+	var permute func(prefix, rest []byte)
+	permute = func(prefix, rest []byte) {
+		if len(rest) == 0 {
+			keySets["anagram"] = append(keySets["anagram"], append([]byte("order-"), prefix...))
+			return
+		}
+		for i := range rest {
+			next := append(append([]byte{}, rest[:i]...), rest[i+1:]...)
+			permute(append(append([]byte{}, prefix...), rest[i]), next)
+		}
+	}
+	permute(nil, []byte("abcdefg"))
+
+	skew := func(art *AdaptiveRadixTree) float64 {
+		var total, largest int
+		for _, size := range art.ShardSizes() {
+			total += size
+			largest = max(largest, size)
+		}
+		return float64(largest) * float64(art.IndexNum) / float64(total)
+	}
+	for name, keys := range keySets {
+		for _, num := range []int64{10, 16} {
+			fnv := NewARTWithHash(num, NewHashFunc(FNV1a))
+			sum := NewARTWithHash(num, NewHashFunc(ByteSum))
+			for _, key := range keys {
+				fnv.Put(key, &data.LogRecordPos{})
+				sum.Put(key, &data.LogRecordPos{})
+			}
+			assert.Equal(t, len(keys), fnv.Size())
+			assert.Less(t, skew(fnv), 1.1, "%s %d", name, num)
+			if name == "anagram" {
+				//所有的key字节之和相同，全部落在同一个分片
+				assert.Equal(t, float64(num), skew(sum))
+			}
+		}
+	}
+}
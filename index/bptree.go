@@ -2,6 +2,8 @@ package index
 
 import (
 	"bitcask/data"
+	"encoding/binary"
+	"os"
 	"path/filepath"
 
 	"go.etcd.io/bbolt"
@@ -11,6 +13,9 @@ const bptreeIndexFileName = "bptree-index"
 
 var indexBucketName = []byte("bitcask-index")
 
+// 升级旧格式数据文件时，已经移动过位置的数据文件id
+var shiftedBucketName = []byte("bitcask-shifted-files")
+
 // BPlusTree B+树索引
 // 主要封装了 go.etcd.io/bbolt 库
 type BPlusTree struct {
@@ -40,18 +45,18 @@ func NewBPlusTree(dirpath string, syncWrites bool) *BPlusTree {
 
 // 向内存索引中存储key对应的数据位置信息
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldVal []byte
+	var oldpos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
-		oldVal = bucket.Get(key)
+		//bbolt 返回的切片只在事务内有效，需要在事务内解码
+		if old := bucket.Get(key); len(old) != 0 {
+			oldpos = data.DecodeLogRecordPos(old)
+		}
 		return bucket.Put(key, data.Encode_LogRecordPos(pos))
 	}); err != nil {
 		panic("failed to put value in bptree")
 	}
-	if len(oldVal) == 0 {
-		return nil
-	}
-	return data.DecodeLogRecordPos(oldVal)
+	return oldpos
 }
 
 // 根据key值取出内存中对应的索引位置信息
@@ -72,20 +77,22 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 
 // 根据key值删除对应的索引位置信息
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	var old []byte
+	var oldpos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
+		//bbolt 返回的切片只在事务内有效，需要在事务内解码
 		if old := bucket.Get(key); len(old) != 0 {
+			oldpos = data.DecodeLogRecordPos(old)
 			return bucket.Delete(key)
 		}
 		return nil
 	}); err != nil {
 		panic("failed to delete bucket in bptree")
 	}
-	if len(old) == 0 {
+	if oldpos == nil {
 		return nil, false
 	}
-	return data.DecodeLogRecordPos(old), true
+	return oldpos, true
 }
 
 // 返回索引中的个数
@@ -110,6 +117,88 @@ func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
+// ShiftBPlusTreePositions 将B+树索引中指向 fileIds 中数据文件的位置向后移动 delta，返回移动的位置个数
+// 所有修改在一个事务中完成，移动过的文件id记录在索引文件中，中断之后重复执行不会再次移动
+// 数据目录中没有B+树索引文件时不做任何事情
+func ShiftBPlusTreePositions(dirpath string, fileIds map[uint32]bool, delta int64) (int, error) {
+	fileName := filepath.Join(dirpath, bptreeIndexFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return 0, nil
+	}
+	bptree, err := bbolt.Open(fileName, 0644, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer bptree.Close()
+
+	var shifted int
+	err = bptree.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if err != nil {
+			return err
+		}
+		done, err := tx.CreateBucketIfNotExists(shiftedBucketName)
+		if err != nil {
+			return err
+		}
+		pending := make(map[uint32]bool)
+		for fid := range fileIds {
+			if done.Get(binary.BigEndian.AppendUint32(nil, fid)) == nil {
+				pending[fid] = true
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		//遍历时修改 bucket 会让游标失效，先收集需要修改的数据
+		var keys, values [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			pos := data.DecodeLogRecordPos(v)
+			if pending[pos.Fid] {
+				pos.Offset += delta
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, data.Encode_LogRecordPos(pos))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for i := range keys {
+			if err := bucket.Put(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		for fid := range pending {
+			if err := done.Put(binary.BigEndian.AppendUint32(nil, fid), []byte{1}); err != nil {
+				return err
+			}
+		}
+		shifted = len(keys)
+		return nil
+	})
+	return shifted, err
+}
+
+// FinishBPlusTreeShift 所有数据文件都升级完成之后，清除移动过位置的数据文件记录
+func FinishBPlusTreeShift(dirpath string) error {
+	fileName := filepath.Join(dirpath, bptreeIndexFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	bptree, err := bbolt.Open(fileName, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer bptree.Close()
+	return bptree.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(shiftedBucketName) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(shiftedBucketName)
+	})
+}
+
 // B+树迭代器
 type bptreeIterator struct {
 	tx        *bbolt.Tx
@@ -3,7 +3,6 @@ package index
 import (
 	"bitcask/data"
 	"bytes"
-	"sort"
 	"sync"
 
 	"github.com/google/btree"
@@ -37,9 +36,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := Item{key: key}
-	bt.lock.Lock()
+	bt.lock.RLock()
 	res := bt.tree.Get(&it)
-	bt.lock.Unlock()
+	bt.lock.RUnlock()
 	if res == nil {
 		return nil
 	}
@@ -62,88 +61,117 @@ func (bt *BTree) Size() int {
 	return bt.tree.Len()
 }
 
+// Clone 利用写时复制生成一个独立的索引副本，代价为 O(1)
+func (bt *BTree) Clone() *BTree {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
 func (bt *BTree) Close() error {
 	return nil
 }
 
+// 索引迭代器，遍历创建时刻的写时复制副本，之后的写入不影响迭代器
 func (bt *BTree) Iterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	// bt.lock.RLock()
-	// defer bt.lock.RUnlock()
-	return NewBtreeIterator(bt.tree, reverse)
+	return NewBtreeIterator(bt.Clone().tree, reverse)
 }
 
-// BTREE 索引迭代器
+// 迭代器每次从副本中读取的数据个数
+const btreeIteratorPageSize = 128
+
+// BTREE 索引迭代器，按批次从索引副本中读取数据
 type btreeIterator struct {
-	curIndex int     //当前位置
-	reverse  bool    //是否是反向遍历
-	values   []*Item //key+LogRecordPos
+	tree    *btree.BTree //创建迭代器时的索引副本，不会再被修改
+	reverse bool         //是否是反向遍历
+	page    []*Item      //当前批次的数据，按照遍历顺序排列
+	index   int          //当前位置
+	done    bool         //当前批次之后没有更多的数据
 }
 
+// tree 在迭代器关闭之前不能被修改，需要并发写入时传入 Clone 得到的副本
 func NewBtreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-
-	//将所有数据存放在数组中
-	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
-	}
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
+	bti := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
+		page:    make([]*Item, 0, btreeIteratorPageSize),
 	}
+	bti.Rewind()
+	return bti
+}
 
-	return &btreeIterator{
-		curIndex: 0,
-		reverse:  reverse,
-		values:   values,
+// 读取 key 之后（反向遍历时为之前）的一批数据，key 为 nil 时从头读取
+func (bti *btreeIterator) load(key []byte, inclusive bool) {
+	bti.page = bti.page[:0]
+	bti.index = 0
+	if bti.tree == nil {
+		bti.done = true
+		return
+	}
+	collect := func(it btree.Item) bool {
+		item := it.(*Item)
+		if !inclusive && bytes.Equal(item.key, key) {
+			return true
+		}
+		bti.page = append(bti.page, item)
+		return len(bti.page) < btreeIteratorPageSize
 	}
+	switch {
+	case key == nil && bti.reverse:
+		bti.tree.Descend(collect)
+	case key == nil:
+		bti.tree.Ascend(collect)
+	case bti.reverse:
+		bti.tree.DescendLessOrEqual(&Item{key: key}, collect)
+	default:
+		bti.tree.AscendGreaterOrEqual(&Item{key: key}, collect)
+	}
+	bti.done = len(bti.page) < btreeIteratorPageSize
 }
 
 // 重新回到迭代器的起点，即第一个数据
 func (bti *btreeIterator) Rewind() {
-	bti.curIndex = 0
+	bti.load(nil, true)
 }
 
 // 根据传入的key，跳转到>= 或（<=）key的第一个位置
 func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.curIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		bti.curIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
-	}
+	bti.load(key, true)
 }
 
 // 跳转到下一个key
 func (bti *btreeIterator) Next() {
-	bti.curIndex++
+	bti.index++
+	if bti.index < len(bti.page) || bti.done {
+		return
+	}
+	bti.load(bti.page[len(bti.page)-1].key, false)
 }
 
 // 是否有效，是否已经遍历完所有的key，用于退出遍历
 func (bti *btreeIterator) Valid() bool {
-	return bti.curIndex >= 0 && bti.curIndex < len(bti.values)
+	return bti.index < len(bti.page)
 }
 
 // 返回当前位置的Key
 func (bti *btreeIterator) Key() []byte {
-	return bti.values[bti.curIndex].key
+	return bti.page[bti.index].key
 }
 
 // 返回当前位置的Value数据
 func (bti *btreeIterator) Value() *data.LogRecordPos {
-	return bti.values[bti.curIndex].pos
+	return bti.page[bti.index].pos
 }
 
 // 关闭迭代器，释放相应资源
 func (bti *btreeIterator) Close() {
-	bti.values = nil
+	bti.tree = nil
+	bti.page = nil
+	bti.index = 0
 }
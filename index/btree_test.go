@@ -2,6 +2,8 @@ package index
 
 import (
 	"bitcask/data"
+	"bitcask/utils"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -87,3 +89,73 @@ func TestBtree_Iterator(t *testing.T) {
 		t.Log(string(iter.Key()))
 	}
 }
+
+func TestBtree_IteratorPaging(t *testing.T) {
+	bt := NewBtree()
+	keys := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i * 2)
+		bt.Put(key, &data.LogRecordPos{Fid: uint32(i)})
+		keys = append(keys, string(key))
+	}
+
+	//跨越多个批次的正向和反向遍历
+	scan := func(iter Iterator) []string {
+		var ans []string
+		for ; iter.Valid(); iter.Next() {
+			ans = append(ans, string(iter.Key()))
+		}
+		return ans
+	}
+	iter := bt.Iterator(false)
+	assert.Equal(t, keys, scan(iter))
+	iter = bt.Iterator(true)
+	reversed := scan(iter)
+	assert.Equal(t, len(keys), len(reversed))
+	for i := range reversed {
+		assert.Equal(t, keys[len(keys)-1-i], reversed[i])
+	}
+
+	//Seek 到存在和不存在的key
+	iter = bt.Iterator(false)
+	iter.Seek(utils.GetTestKey(500))
+	assert.Equal(t, keys[250:], scan(iter))
+	iter.Seek(utils.GetTestKey(501))
+	assert.Equal(t, keys[251:], scan(iter))
+	iter = bt.Iterator(true)
+	iter.Seek(utils.GetTestKey(501))
+	assert.Equal(t, 251, len(scan(iter)))
+	iter.Seek(utils.GetTestKey(0))
+	assert.Equal(t, []string{keys[0]}, scan(iter))
+
+	//迭代器创建之后的写入不可见
+	iter = bt.Iterator(false)
+	for i := 0; i < 1000; i++ {
+		bt.Delete(utils.GetTestKey(i * 2))
+		bt.Put(utils.GetTestKey(i*2+1), &data.LogRecordPos{})
+	}
+	assert.Equal(t, keys, scan(iter))
+	iter.Close()
+	assert.False(t, iter.Valid())
+}
+
+func TestBtree_IteratorAllocs(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 100000; i++ {
+		bt.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: uint32(i)})
+	}
+
+	//创建迭代器读取少量数据之后关闭，不复制整个索引
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		iter := bt.Iterator(i%2 == 0)
+		iter.Seek(utils.GetTestKey(i * 1000))
+		for j := 0; j < 10 && iter.Valid(); j++ {
+			iter.Next()
+		}
+		iter.Close()
+	}
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
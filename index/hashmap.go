@@ -0,0 +1,165 @@
+package index
+
+import (
+	"bitcask/data"
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// ShardedHashMap 分片哈希表索引，只适合点查询
+// Put、Get、Delete 为 O(1)，遍历时需要复制所有的key并排序
+type ShardedHashMap struct {
+	shards   []map[string]*data.LogRecordPos
+	lock     []*sync.RWMutex
+	hash     HashFunc //选择分片的哈希函数
+	IndexNum int64
+}
+
+// NewShardedHashMap 创建分片哈希表索引，hash 为空时使用 FNV-1a
+func NewShardedHashMap(num int64, hash HashFunc) *ShardedHashMap {
+	if hash == nil {
+		hash = FNV1aHash
+	}
+	hm := &ShardedHashMap{
+		shards:   make([]map[string]*data.LogRecordPos, num),
+		lock:     make([]*sync.RWMutex, num),
+		hash:     hash,
+		IndexNum: num,
+	}
+	for i := 0; i < int(num); i++ {
+		hm.shards[i] = make(map[string]*data.LogRecordPos)
+		hm.lock[i] = new(sync.RWMutex)
+	}
+	return hm
+}
+
+// key 所在的分片
+func (hm *ShardedHashMap) shard(key []byte) int {
+	return int(hm.hash(key) % uint64(hm.IndexNum))
+}
+
+// 向内存索引中存储key对应的数据位置信息
+func (hm *ShardedHashMap) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	index := hm.shard(key)
+	hm.lock[index].Lock()
+	old := hm.shards[index][string(key)]
+	hm.shards[index][string(key)] = pos
+	hm.lock[index].Unlock()
+	return old
+}
+
+// 根据key值取出内存中对应的索引位置信息
+func (hm *ShardedHashMap) Get(key []byte) *data.LogRecordPos {
+	index := hm.shard(key)
+	hm.lock[index].RLock()
+	defer hm.lock[index].RUnlock()
+	return hm.shards[index][string(key)]
+}
+
+// 根据key值删除对应的索引位置信息
+func (hm *ShardedHashMap) Delete(key []byte) (*data.LogRecordPos, bool) {
+	index := hm.shard(key)
+	hm.lock[index].Lock()
+	defer hm.lock[index].Unlock()
+	old, ok := hm.shards[index][string(key)]
+	if !ok {
+		return nil, false
+	}
+	delete(hm.shards[index], string(key))
+	return old, true
+}
+
+// 返回索引中的个数
+func (hm *ShardedHashMap) Size() int {
+	var size int
+	for _, n := range hm.ShardSizes() {
+		size += n
+	}
+	return size
+}
+
+// 每个分片中的key数量
+func (hm *ShardedHashMap) ShardSizes() []int {
+	sizes := make([]int, hm.IndexNum)
+	for i := 0; i < int(hm.IndexNum); i++ {
+		hm.lock[i].RLock()
+		sizes[i] = len(hm.shards[i])
+		hm.lock[i].RUnlock()
+	}
+	return sizes
+}
+
+func (hm *ShardedHashMap) Close() error {
+	return nil
+}
+
+// 索引迭代器，创建时复制所有的key并排序，代价为 O(NlogN)
+func (hm *ShardedHashMap) Iterator(reverse bool) Iterator {
+	values := make([]*Item, 0, hm.Size())
+	for i := 0; i < int(hm.IndexNum); i++ {
+		hm.lock[i].RLock()
+		for key, pos := range hm.shards[i] {
+			values = append(values, &Item{key: []byte(key), pos: pos})
+		}
+		hm.lock[i].RUnlock()
+	}
+	sort.Slice(values, func(i, j int) bool {
+		cmp := bytes.Compare(values[i].key, values[j].key)
+		if reverse {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	return &hashMapIterator{reverse: reverse, values: values}
+}
+
+// HashMap 索引迭代器
+type hashMapIterator struct {
+	curIndex int     //当前位置
+	reverse  bool    //是否是反向遍历
+	values   []*Item //按照遍历顺序排好序的 key+LogRecordPos
+}
+
+// 重新回到迭代器的起点，即第一个数据
+func (hmi *hashMapIterator) Rewind() {
+	hmi.curIndex = 0
+}
+
+// 根据传入的key，跳转到>= 或（<=）key的第一个位置
+func (hmi *hashMapIterator) Seek(key []byte) {
+	if hmi.reverse {
+		hmi.curIndex = sort.Search(len(hmi.values), func(i int) bool {
+			return bytes.Compare(hmi.values[i].key, key) <= 0
+		})
+	} else {
+		hmi.curIndex = sort.Search(len(hmi.values), func(i int) bool {
+			return bytes.Compare(hmi.values[i].key, key) >= 0
+		})
+	}
+}
+
+// 跳转到下一个key
+func (hmi *hashMapIterator) Next() {
+	hmi.curIndex++
+}
+
+// 是否有效，是否已经遍历完所有的key，用于退出遍历
+func (hmi *hashMapIterator) Valid() bool {
+	return hmi.curIndex >= 0 && hmi.curIndex < len(hmi.values)
+}
+
+// 返回当前位置的Key
+func (hmi *hashMapIterator) Key() []byte {
+	return hmi.values[hmi.curIndex].key
+}
+
+// 返回当前位置的Value数据
+func (hmi *hashMapIterator) Value() *data.LogRecordPos {
+	return hmi.values[hmi.curIndex].pos
+}
+
+// 关闭迭代器，释放相应资源
+func (hmi *hashMapIterator) Close() {
+	hmi.values = nil
+}
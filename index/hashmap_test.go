@@ -0,0 +1,84 @@
+package index
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedHashMap_PutGetDelete(t *testing.T) {
+	hm := NewShardedHashMap(10, nil)
+	assert.Nil(t, hm.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 10}))
+	old := hm.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 20})
+	assert.Equal(t, uint32(1), old.Fid)
+	assert.Equal(t, int64(20), hm.Get([]byte("a")).Offset)
+	assert.Nil(t, hm.Get([]byte("b")))
+	assert.Equal(t, 1, hm.Size())
+
+	pos, ok := hm.Delete([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), pos.Fid)
+	pos, ok = hm.Delete([]byte("a"))
+	assert.False(t, ok)
+	assert.Nil(t, pos)
+	assert.Equal(t, 0, hm.Size())
+}
+
+func TestShardedHashMap_Iterator(t *testing.T) {
+	hm := NewShardedHashMap(4, nil)
+	iter := hm.Iterator(false)
+	assert.False(t, iter.Valid())
+
+	for i := 0; i < 100; i++ {
+		hm.Put(utils.GetTestKey(i*2), &data.LogRecordPos{Fid: uint32(i)})
+	}
+	//遍历时按照key排序
+	iter = hm.Iterator(false)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, utils.GetTestKey(count*2), iter.Key())
+		assert.Equal(t, uint32(count), iter.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 100, count)
+	iter.Seek(utils.GetTestKey(51))
+	assert.Equal(t, utils.GetTestKey(52), iter.Key())
+
+	iter = hm.Iterator(true)
+	assert.Equal(t, utils.GetTestKey(198), iter.Key())
+	iter.Seek(utils.GetTestKey(51))
+	assert.Equal(t, utils.GetTestKey(50), iter.Key())
+	iter.Close()
+	assert.False(t, iter.Valid())
+
+	assert.Equal(t, 4, len(hm.ShardSizes()))
+	var total int
+	for _, size := range hm.ShardSizes() {
+		total += size
+	}
+	assert.Equal(t, 100, total)
+}
+
+func TestShardedHashMap_MultiThread(t *testing.T) {
+	hm := NewShardedHashMap(10, nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				key := utils.GetTestKey(g*10000 + i)
+				hm.Put(key, &data.LogRecordPos{Fid: uint32(g)})
+				assert.Equal(t, uint32(g), hm.Get(key).Fid)
+				if i%2 == 0 {
+					hm.Delete(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 40000, hm.Size())
+}
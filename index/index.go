@@ -36,27 +36,77 @@ const (
 	ART
 
 	BPtree
+
+	HashMap
 )
 
-// NEWIndexer 根据类型初始化索引
-func NEWIndexer(tp IndexType, dirpath string, sync bool, IndexNum int64) Indexer {
+// NEWIndexer 根据类型初始化索引，hash 为分片索引选择分片的哈希函数，为空时使用 FNV-1a
+func NEWIndexer(tp IndexType, dirpath string, sync bool, IndexNum int64, hash HashFunc) Indexer {
 	switch tp {
 	case Btree:
 		return NewBtree()
 	case ART:
-		return NewART(IndexNum)
+		return NewARTWithHash(IndexNum, hash)
 	case BPtree:
 		return NewBPlusTree(dirpath, sync)
+	case HashMap:
+		return NewShardedHashMap(IndexNum, hash)
 	default:
 		panic("unsupported index type")
 	}
 }
-func Hash(data []byte, IndexNum int64) int {
-	var integer int
-	for i := 0; i < len(data); i++ {
-		integer += int(data[i])
+
+// 分片索引的统计信息
+type Sharded interface {
+	//每个分片中的key数量
+	ShardSizes() []int
+}
+
+// HashFunc 分片哈希函数，key 所在的分片为哈希值对分片个数取模
+type HashFunc func(key []byte) uint64
+
+type HashType = int8
+
+const (
+	//FNV-1a 哈希，结果经过再次混合，共享长前缀的key同样分布均匀
+	FNV1a HashType = iota + 1
+
+	//所有字节求和，早期版本的实现，字节相同顺序不同的key落在同一个分片
+	ByteSum
+)
+
+// NewHashFunc 根据类型返回分片哈希函数
+func NewHashFunc(tp HashType) HashFunc {
+	switch tp {
+	case ByteSum:
+		return ByteSumHash
+	default:
+		return FNV1aHash
+	}
+}
+
+// FNV1aHash 64 位 FNV-1a 哈希，最后使用 murmur3 的 fmix64 混合，取模时低位同样均匀
+func FNV1aHash(key []byte) uint64 {
+	var h uint64 = 14695981039346656037
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// ByteSumHash 所有字节的和
+func ByteSumHash(key []byte) uint64 {
+	var sum uint64
+	for _, b := range key {
+		sum += uint64(b)
 	}
-	return integer % int(IndexNum)
+	return sum
 }
 
 type Item struct {
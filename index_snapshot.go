@@ -0,0 +1,354 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	索引快照文件
+	第一条记录保存快照时的数据文件状态，Key 为空
+	之后每条记录对应索引中的一个 <Key,Pos>
+	最后一条记录为结束标记，Key 为空，Value 为索引数据的个数，没有结束标记的快照不能使用
+*/
+
+var errInvalidIndexSnapshot = errors.New("invalid index snapshot")
+
+// 快照时一个数据文件的状态
+type snapshotFile struct {
+	fileId   uint32
+	size     int64 //文件长度，活跃文件为写入位置
+	deadSize int64 //文件中无效数据的字节数
+}
+
+// 索引快照覆盖的范围，活跃文件 offset 之后写入的数据需要从数据文件中重放
+type indexSnapshot struct {
+	fileId uint32 //快照时的活跃文件
+	offset int64  //快照时活跃文件的写入位置
+	seqNo  int64  //快照时的事务序列号
+	files  []snapshotFile
+}
+
+// 位置是否在快照覆盖的范围之后，这些数据在启动时从数据文件中重放
+func (s *indexSnapshot) replays(pos *data.LogRecordPos) bool {
+	return pos.Fid > s.fileId || pos.Fid == s.fileId && pos.Offset >= s.offset
+}
+
+func (s *indexSnapshot) encode() []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(3+3*len(s.files)))
+	buf = binary.AppendUvarint(buf, uint64(s.fileId))
+	buf = binary.AppendVarint(buf, s.offset)
+	buf = binary.AppendVarint(buf, s.seqNo)
+	buf = binary.AppendUvarint(buf, uint64(len(s.files)))
+	for _, file := range s.files {
+		buf = binary.AppendUvarint(buf, uint64(file.fileId))
+		buf = binary.AppendVarint(buf, file.size)
+		buf = binary.AppendVarint(buf, file.deadSize)
+	}
+	return buf
+}
+
+func decodeIndexSnapshot(buf []byte) (*indexSnapshot, error) {
+	var index int
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			index = -1
+			return 0
+		}
+		index += n
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			index = -1
+			return 0
+		}
+		index += n
+		return v
+	}
+
+	s := &indexSnapshot{}
+	s.fileId = uint32(uvarint())
+	if index < 0 {
+		return nil, errInvalidIndexSnapshot
+	}
+	s.offset = varint()
+	if index < 0 {
+		return nil, errInvalidIndexSnapshot
+	}
+	s.seqNo = varint()
+	if index < 0 {
+		return nil, errInvalidIndexSnapshot
+	}
+	n := uvarint()
+	for i := uint64(0); i < n && index >= 0; i++ {
+		file := snapshotFile{fileId: uint32(uvarint())}
+		if index < 0 {
+			break
+		}
+		file.size = varint()
+		if index < 0 {
+			break
+		}
+		file.deadSize = varint()
+		s.files = append(s.files, file)
+	}
+	if index < 0 || index != len(buf) {
+		return nil, errInvalidIndexSnapshot
+	}
+	return s, nil
+}
+
+// 将内存索引保存为快照，持有读锁时只记录数据文件状态，读取索引和写入文件时不阻塞读写
+func (db *DB) writeIndexSnapshot() (err error) {
+	db.indexSnapshotMu.Lock()
+	defer db.indexSnapshotMu.Unlock()
+
+	//组提交先写数据再更新索引，拿到写入令牌保证没有写了数据但还没有更新索引的请求
+	db.commitToken <- struct{}{}
+	db.mu.RLock()
+	if db.activefile == nil {
+		db.mu.RUnlock()
+		<-db.commitToken
+		return nil
+	}
+	snapshot := &indexSnapshot{
+		fileId: db.activefile.FileId,
+		offset: db.activefile.Writeoff,
+		seqNo:  atomic.LoadInt64(&db.seqNo),
+	}
+	for _, dataFile := range db.olderfile {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			db.mu.RUnlock()
+			<-db.commitToken
+			return err
+		}
+		snapshot.files = append(snapshot.files, snapshotFile{fileId: dataFile.FileId, size: size, deadSize: dataFile.DeadSize})
+	}
+	snapshot.files = append(snapshot.files, snapshotFile{
+		fileId:   db.activefile.FileId,
+		size:     db.activefile.Writeoff,
+		deadSize: db.activefile.DeadSize,
+	})
+	//BTree 的写时复制副本和文件状态完全一致，代价为 O(1)
+	var iterator index.Iterator
+	if bt, ok := db.index.(*index.BTree); ok {
+		iterator = bt.Clone().Iterator(false)
+	}
+	indexer := db.index
+	db.mu.RUnlock()
+	<-db.commitToken
+
+	//其他索引在释放锁之后逐个分片读取，只持有分片自己的锁
+	//读取期间新写入的位置在快照覆盖的范围之后，启动时会从数据文件中重放，不写入快照
+	if iterator == nil {
+		iterator = indexer.Iterator(false)
+	}
+	defer iterator.Close()
+
+	//之前的快照在新快照写完之前就已经无效，写入中断时启动会从头加载
+	if err := removeIndexSnapshot(db.options.Dirpath); err != nil {
+		return err
+	}
+	snapshotFile, err := data.OpenIndexSnapshotFile(db.options.Dirpath, db.options.EncryptionKeys)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := snapshotFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = removeIndexSnapshot(db.options.Dirpath)
+		}
+	}()
+
+	write := func(record *data.LogRecord) error {
+		encRecord, _ := snapshotFile.EncodeRecord(record)
+		return snapshotFile.Write(encRecord)
+	}
+	if err := write(&data.LogRecord{Value: snapshot.encode()}); err != nil {
+		return err
+	}
+	var count uint64
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if snapshot.replays(iterator.Value()) {
+			continue
+		}
+		if err := write(&data.LogRecord{Key: iterator.Key(), Value: data.Encode_LogRecordPos(iterator.Value())}); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := write(&data.LogRecord{Value: binary.AppendUvarint(nil, count)}); err != nil {
+		return err
+	}
+	return snapshotFile.Sync()
+}
+
+// 加载索引快照，快照不存在、不完整或者和数据文件不一致时返回 nil，此时需要从头加载索引
+// 快照中的数据文件在之后被 Merge 删除或者被修改时，快照不一致
+func (db *DB) loadIndexSnapshot() (*indexSnapshot, error) {
+	fileName := filepath.Join(db.options.Dirpath, data.IndexSnapshotFileName)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, nil
+	}
+	//关闭快照之后不再维护，删除旧的快照
+	if !db.options.IndexSnapshot {
+		return nil, removeIndexSnapshot(db.options.Dirpath)
+	}
+
+	snapshotFile, err := data.OpenIndexSnapshotFile(db.options.Dirpath, db.options.EncryptionKeys)
+	if err != nil {
+		return nil, nil
+	}
+	defer snapshotFile.Close()
+
+	record, size, err := snapshotFile.ReadRecord(snapshotFile.DataOffset())
+	if err != nil || len(record.Key) != 0 {
+		return nil, nil
+	}
+	snapshot, err := decodeIndexSnapshot(record.Value)
+	if err != nil || !db.snapshotMatches(snapshot) {
+		return nil, nil
+	}
+
+	//逐条加载到索引中，没有读到结束标记时丢弃已经加载的数据
+	now := time.Now().UnixNano()
+	var offset = snapshotFile.DataOffset() + size
+	var count uint64
+	var expired []*data.LogRecordPos
+	for {
+		record, size, err := snapshotFile.ReadRecord(offset)
+		if err != nil {
+			db.index = newIndexer(db.options)
+			return nil, nil
+		}
+		offset += size
+		if len(record.Key) == 0 {
+			if n, _ := binary.Uvarint(record.Value); n != count {
+				db.index = newIndexer(db.options)
+				return nil, nil
+			}
+			break
+		}
+		count++
+		pos := data.DecodeLogRecordPos(record.Value)
+		//快照之后过期的数据等同于被删除
+		if pos.Expired(now) {
+			expired = append(expired, pos)
+			continue
+		}
+		db.index.Put(record.Key, pos)
+	}
+
+	//恢复每个数据文件中的无效数据
+	db.DeletedSize = 0
+	for _, file := range snapshot.files {
+		dataFile := db.olderfile[file.fileId]
+		if dataFile == nil {
+			dataFile = db.activefile
+		}
+		dataFile.DeadSize = file.deadSize
+		db.DeletedSize += file.deadSize
+	}
+	for _, pos := range expired {
+		db.addDeletedSize(pos)
+	}
+	return snapshot, nil
+}
+
+// 快照中的数据文件和数据目录中快照活跃文件之前的数据文件完全一致
+func (db *DB) snapshotMatches(snapshot *indexSnapshot) bool {
+	files := make(map[uint32]int64, len(snapshot.files))
+	for _, file := range snapshot.files {
+		files[file.fileId] = file.size
+	}
+	if len(files) != len(snapshot.files) || files[snapshot.fileId] != snapshot.offset {
+		return false
+	}
+	var covered int
+	for _, fid := range db.fileIds {
+		if uint32(fid) > snapshot.fileId {
+			break
+		}
+		expected, ok := files[uint32(fid)]
+		if !ok {
+			return false
+		}
+		covered++
+
+		dataFile := db.olderfile[uint32(fid)]
+		if dataFile == nil {
+			dataFile = db.activefile
+		}
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return false
+		}
+		//快照时的活跃文件之后可能继续写入
+		if uint32(fid) == snapshot.fileId {
+			if size < expected {
+				return false
+			}
+		} else if size != expected {
+			return false
+		}
+	}
+	return covered == len(files)
+}
+
+func removeIndexSnapshot(dirpath string) error {
+	if err := os.Remove(filepath.Join(dirpath, data.IndexSnapshotFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 启动后台定期保存索引快照的协程
+func (db *DB) startIndexSnapshot() {
+	if !db.options.IndexSnapshot || db.options.IndexSnapshotInterval <= 0 || db.options.IndexType == BPlusTree {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	db.indexSnapshotCancel = cancel
+	db.indexSnapshotWg = new(sync.WaitGroup)
+	db.indexSnapshotWg.Add(1)
+	go db.runIndexSnapshot(ctx)
+}
+
+// 停止后台保存索引快照的协程，等待正在写入的快照完成
+func (db *DB) stopIndexSnapshot() {
+	if db.indexSnapshotCancel == nil {
+		return
+	}
+	db.indexSnapshotCancel()
+	db.indexSnapshotWg.Wait()
+	db.indexSnapshotCancel = nil
+}
+
+func (db *DB) runIndexSnapshot(ctx context.Context) {
+	defer db.indexSnapshotWg.Done()
+
+	ticker := time.NewTicker(db.options.IndexSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = db.writeIndexSnapshot()
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.IndexSnapshot = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		key, value := utils.GetTestKey(i%150), utils.RandomValue(32)
+		assert.Nil(t, db.Put(key, value))
+		expected[string(key)] = value
+	}
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("ttl"), []byte("value"), time.Hour))
+	expected["ttl"] = []byte("value")
+	assert.Nil(t, db.PutWithTTL([]byte("expired"), []byte("value"), 50*time.Millisecond))
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+
+	snapshotName := filepath.Join(dir, data.IndexSnapshotFileName)
+	_, err = os.Stat(snapshotName)
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+	}
+
+	//从快照加载，快照之后过期的数据同样不可见
+	time.Sleep(100 * time.Millisecond)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	_, err = db2.Get([]byte("expired"))
+	assert.Equal(t, ErrKeyNotFind, err)
+	stat2 := db2.Stat()
+	assert.Equal(t, stat.DataFileNum, stat2.DataFileNum)
+	assert.Greater(t, stat2.DeletedSize, stat.DeletedSize)
+
+	//快照之后的写入以及跨越多个数据文件的批次从数据文件中重放
+	wb := db2.NewWriteBatch(DefalutWriteBatchOptions)
+	for i := 150; i < 400; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(32)
+		assert.Nil(t, wb.Put(key, value))
+		expected[string(key)] = value
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db2.Delete(utils.GetTestKey(30)))
+	delete(expected, string(utils.GetTestKey(30)))
+	//模拟没有正常关闭，快照仍然是上一次关闭时保存的
+	content, err := os.ReadFile(snapshotName)
+	assert.Nil(t, err)
+	assert.Nil(t, db2.Close())
+	assert.Nil(t, os.WriteFile(snapshotName, content, 0644))
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	check(db3)
+	stat3 := db3.Stat()
+	assert.Nil(t, db3.Close())
+
+	//和不使用快照从头加载的结果相同
+	opts.IndexSnapshot = false
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	check(db4)
+	stat4 := db4.Stat()
+	assert.Equal(t, stat4.KeyNum, stat3.KeyNum)
+	assert.Equal(t, stat4.DeletedSize, stat3.DeletedSize)
+	assert.Nil(t, db4.Close())
+	//关闭快照之后旧的快照被删除
+	_, err = os.Stat(snapshotName)
+	assert.True(t, os.IsNotExist(err))
+
+	//不完整的快照不使用
+	opts.IndexSnapshot = true
+	db5, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db5.Close())
+	content, err = os.ReadFile(snapshotName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(snapshotName, content[:len(content)-10], 0644))
+	db6, err := Open(opts)
+	assert.Nil(t, err)
+	check(db6)
+	assert.Equal(t, stat4.KeyNum, db6.Stat().KeyNum)
+	assert.Equal(t, stat4.DeletedSize, db6.Stat().DeletedSize)
+
+	//Merge 之后快照失效
+	db6.options.DataFileMergeRatio = 0
+	assert.Nil(t, db6.Merge())
+	_, err = os.Stat(snapshotName)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db6.Put([]byte("after-merge"), []byte("value")))
+	expected["after-merge"] = []byte("value")
+	assert.Nil(t, db6.Close())
+
+	db7, err := Open(opts)
+	defer destroyDB(db7)
+	assert.Nil(t, err)
+	check(db7)
+}
+
+func TestDB_IndexSnapshotMismatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.IndexSnapshot = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+	}
+	assert.Nil(t, db.Close())
+
+	//快照中的数据文件被删除之后，从剩余的数据文件从头加载
+	assert.Nil(t, os.Remove(data.GetDataFileName(dir, 0)))
+	assert.Nil(t, removeHintFile(dir, 0))
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFind, err)
+	val, err := db2.Get(utils.GetTestKey(299))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Less(t, len(db2.ListKeys()), 300)
+}
+
+func TestDB_IndexSnapshotInterval(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.IndexSnapshot = true
+	opts.IndexSnapshotInterval = 20 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//写入和后台保存快照并发进行
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+		if i%100 == 0 {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, data.IndexSnapshotFileName))
+	assert.Nil(t, err)
+
+	//使用后台保存的快照启动，快照之后的写入从数据文件中重放
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	content, err := os.ReadFile(filepath.Join(dir, data.IndexSnapshotFileName))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, data.IndexSnapshotFileName), content, 0644))
+
+	opts.IndexSnapshotInterval = 0
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 600, len(db2.ListKeys()))
+
+	opts.IndexSnapshotInterval = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+// 保存快照时不持有锁读取索引，和并发的写入交错之后从快照启动，数据依然一致
+func TestDB_IndexSnapshotConcurrentWrites(t *testing.T) {
+	for _, tp := range []IndexType{Btree, ART, HashMap} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.DataFileSize = 16 * 1024
+		opts.IndexType = tp
+		opts.IndexSnapshot = true
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		expected := make(map[string][]byte)
+		for i := 0; i < 1000; i++ {
+			key, value := utils.GetTestKey(i), utils.RandomValue(16)
+			assert.Nil(t, db.Put(key, value))
+			expected[string(key)] = value
+		}
+
+		stop := make(chan struct{})
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; ; round++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := utils.GetTestKey(round * 13 % 1500)
+				if round%4 == 0 {
+					assert.Nil(t, db.Delete(key))
+					delete(expected, string(key))
+				} else {
+					value := utils.RandomValue(16)
+					assert.Nil(t, db.Put(key, value))
+					expected[string(key)] = value
+				}
+			}
+		}()
+		for i := 0; i < 5; i++ {
+			assert.Nil(t, db.writeIndexSnapshot())
+		}
+		close(stop)
+		wg.Wait()
+
+		//使用并发写入期间保存的快照启动
+		snapshotName := filepath.Join(dir, data.IndexSnapshotFileName)
+		content, err := os.ReadFile(snapshotName)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+		assert.Nil(t, os.WriteFile(snapshotName, content, 0644))
+
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, len(expected), len(db2.ListKeys()))
+		for key, value := range expected {
+			val, err := db2.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		assert.Nil(t, db2.Close())
+		destroyDB(db2)
+	}
+}
+
+// Merge 生成新的数据文件之后、生效之前崩溃，重启时不能加载临时实例的索引快照
+func TestDB_IndexSnapshotMergeCrash(t *testing.T) {
+	fi, restore := injectFaults()
+	defer restore()
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexSnapshot = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key, value := utils.GetTestKey(i%500), utils.RandomValue(32)
+		assert.Nil(t, db.Put(key, value))
+		expected[string(key)] = value
+	}
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+
+	//只执行 Merge 的第一阶段，不替换数据文件
+	db.mu.Lock()
+	job, err := db.prepareMerge()
+	db.mu.Unlock()
+	assert.Nil(t, err)
+	assert.Nil(t, db.mergeToDir(context.Background(), job, MergeOptions{}))
+	_, err = os.Stat(filepath.Join(db.getMergePath(), data.IndexSnapshotFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	db2 := crashAndReopen(t, db, fi, restore)
+	defer destroyDB(db2)
+	assert.Equal(t, len(expected), len(db2.ListKeys()))
+	for key, value := range expected {
+		val, err := db2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
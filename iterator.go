@@ -1,8 +1,10 @@
 package bitcaskkvdb
 
 import (
+	"bitcask/data"
 	"bitcask/index"
 	"bytes"
+	"time"
 )
 
 //供用户调用的Iterator <数据迭代器>
@@ -10,26 +12,47 @@ import (
 type Iterator struct {
 	indexIter index.Iterator //<索引迭代器>
 	db        *DB
+	snap      *Snapshot                 //非空时从快照中读取数据
+	files     map[uint32]*data.DataFile //创建迭代器时引用的数据文件，Merge 之后依然可以读取
 	Options   IteratorOptions
+	finished  bool //已经遍历完前缀范围内的所有key
 }
 
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	indexiter := db.index.Iterator(opts.Reverse)
 	return &Iterator{
 		db:        db,
 		indexIter: indexiter,
+		files:     db.refDataFiles(),
 		Options:   opts,
 	}
 }
 
 // 重新回到迭代器的起点，即第一个数据
+// 指定了前缀时直接跳转到前缀范围的起点
 func (it *Iterator) Rewind() {
-	it.indexIter.Rewind()
+	it.finished = false
+	prefix := it.Options.Prefix
+	switch {
+	case len(prefix) == 0:
+		it.indexIter.Rewind()
+	case !it.Options.Reverse:
+		it.indexIter.Seek(prefix)
+	default:
+		if end := prefixEnd(prefix); end != nil {
+			it.indexIter.Seek(end)
+		} else {
+			it.indexIter.Rewind()
+		}
+	}
 	it.skipToNext()
 }
 
 // 根据传入的key，跳转到>= 或（<=）key的第一个位置
 func (it *Iterator) Seek(key []byte) {
+	it.finished = false
 	it.indexIter.Seek(key)
 	it.skipToNext()
 }
@@ -42,7 +65,7 @@ func (it *Iterator) Next() {
 
 // 是否有效，是否已经遍历完所有的key，用于退出遍历
 func (it *Iterator) Valid() bool {
-	return it.indexIter.Valid()
+	return !it.finished && it.indexIter.Valid()
 }
 
 // 返回当前位置的Key
@@ -53,25 +76,52 @@ func (it *Iterator) Key() []byte {
 // 返回当前位置的Value数据
 func (it *Iterator) Value() ([]byte, error) {
 	logpos := it.indexIter.Value()
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
+	if it.snap != nil {
+		return it.snap.getValueByPostion(logpos)
+	}
+	if dataFile, ok := it.files[logpos.Fid]; ok {
+		return readValueFromFile(dataFile, logpos)
+	}
 	return it.db.getValueByPostion(logpos)
 }
 
 // 关闭迭代器，释放相应资源
 func (it *Iterator) Close() {
 	it.indexIter.Close()
+	unrefDataFiles(it.files)
+	it.files = nil
 }
 
+// 跳过前缀不匹配以及已经过期的key
 func (it *Iterator) skipToNext() {
 	prefixlen := len(it.Options.Prefix)
-	if prefixlen == 0 {
-		return
-	}
+	now := time.Now().UnixNano()
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
 		key := it.indexIter.Key()
-		if prefixlen <= len(key) && bytes.Equal(it.Options.Prefix, key[:prefixlen]) {
-			break
+		if prefixlen > 0 && !bytes.HasPrefix(key, it.Options.Prefix) {
+			//key 有序，越过前缀范围之后不会再有匹配的key
+			if cmp := bytes.Compare(key, it.Options.Prefix); (cmp > 0) != it.Options.Reverse {
+				it.finished = true
+				return
+			}
+			continue
+		}
+		if it.indexIter.Value().Expired(now) {
+			continue
+		}
+		break
+	}
+}
+
+// 大于所有以 prefix 为前缀的key的最小key，prefix 全部为 0xff 时返回 nil
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
 		}
 	}
+	return nil
 }
@@ -49,3 +49,52 @@ func TestDB_NewIterator(t *testing.T) {
 		t.Log(string(value))
 	}
 }
+
+func TestDB_IteratorPrefix(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, ART} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		keys := []string{"a", "az", "b", "b\x00", "ba", "bz", "b\xff", "b\xff\xff", "c", "\xff", "\xff\xff", "\xff\xffa"}
+		for _, key := range keys {
+			assert.Nil(t, db.Put([]byte(key), []byte(key)))
+		}
+		scan := func(prefix string, reverse bool) []string {
+			iteropts := DefalutIteratorOptions
+			iteropts.Prefix = []byte(prefix)
+			iteropts.Reverse = reverse
+			iter := db.NewIterator(iteropts)
+			defer iter.Close()
+			var ans []string
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				ans = append(ans, string(iter.Key()))
+			}
+			return ans
+		}
+		//前缀范围内的key按顺序全部遍历到，范围之外的key不可见
+		assert.Equal(t, []string{"b", "b\x00", "ba", "bz", "b\xff", "b\xff\xff"}, scan("b", false))
+		assert.Equal(t, []string{"b\xff\xff", "b\xff", "bz", "ba", "b\x00", "b"}, scan("b", true))
+		assert.Equal(t, []string{"\xff\xff", "\xff\xffa"}, scan("\xff\xff", false))
+		assert.Equal(t, []string{"\xff\xffa", "\xff\xff"}, scan("\xff\xff", true))
+		assert.Equal(t, []string(nil), scan("bb", false))
+		assert.Equal(t, []string(nil), scan("bb", true))
+
+		//Seek 之后同样只遍历前缀范围内的key
+		iteropts := DefalutIteratorOptions
+		iteropts.Prefix = []byte("b")
+		iter := db.NewIterator(iteropts)
+		iter.Seek([]byte("a"))
+		assert.Equal(t, []byte("b"), iter.Key())
+		iter.Seek([]byte("bb"))
+		assert.Equal(t, []byte("bz"), iter.Key())
+		iter.Seek([]byte("c"))
+		assert.False(t, iter.Valid())
+		iter.Close()
+
+		destroyDB(db)
+	}
+}
@@ -0,0 +1,137 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"io"
+	"sync"
+)
+
+// 启动时一个数据文件的解码结果
+type loadedFile struct {
+	entries  []*hintEntry   //文件中的所有数据，按照在文件中的顺序排列
+	writeoff int64          //最后一条有效数据之后的位置
+	recovery RecoveryReport //该文件的恢复结果
+	err      error
+}
+
+// 并发解码数据文件，解码结果按照文件id的顺序交给 apply 处理，保证后写入的数据覆盖先写入的数据
+// 最多 LoadConcurrency 个文件同时在解码或者等待处理，限制暂存结果占用的内存
+// 活跃文件在之前的文件都处理成功之后才解码，旧文件损坏时不会截断活跃文件
+// 第一个文件从 from 开始解码，from 为 0 时从头解码
+func (db *DB) decodeDataFiles(dataFiles []*data.DataFile, from int64, apply func(i int, file *loadedFile) error) error {
+	concurrency := max(db.options.LoadConcurrency, 1)
+	olderFiles := dataFiles[:len(dataFiles)-1]
+	results := make([]chan *loadedFile, len(olderFiles))
+	for i := range results {
+		results[i] = make(chan *loadedFile, 1)
+	}
+
+	tokens := make(chan struct{}, concurrency)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, dataFile := range olderFiles {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(i int, dataFile *data.DataFile) {
+				defer wg.Done()
+				var offset int64
+				if i == 0 {
+					offset = from
+				}
+				results[i] <- db.decodeDataFile(dataFile, false, offset)
+			}(i, dataFile)
+		}
+	}()
+	//出错时等待正在解码的文件完成，之后才能关闭这些文件
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := range olderFiles {
+		file := <-results[i]
+		<-tokens
+		if err := apply(i, file); err != nil {
+			return err
+		}
+	}
+	var offset int64
+	if len(olderFiles) == 0 {
+		offset = from
+	}
+	return apply(len(olderFiles), db.decodeDataFile(dataFiles[len(olderFiles)], true, offset))
+}
+
+// 解码数据文件中的所有数据，旧文件优先从 Hint 文件加载，无法使用的 Hint 文件删除后重新生成
+// from 大于 0 时只解码 from 之后的数据，不使用 Hint 文件
+func (db *DB) decodeDataFile(dataFile *data.DataFile, isActive bool, from int64) *loadedFile {
+	file := &loadedFile{}
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		file.err = err
+		return file
+	}
+
+	if !isActive && from == 0 {
+		if entries, ok := db.loadHintEntries(dataFile, fileSize); ok {
+			file.entries = entries
+			return file
+		}
+		if err := removeHintFile(db.options.Dirpath, dataFile.FileId); err != nil {
+			file.err = err
+			return file
+		}
+	}
+
+	var offset = max(dataFile.DataOffset(), from)
+	//循环遍历Entry，目的是得到每个Entry所在的Offset
+	for {
+		logRecord, size, err := dataFile.ReadRecord(offset)
+		if err != nil {
+			if err == io.EOF && offset >= fileSize {
+				break
+			}
+			//可写内存映射预留的空间在进程退出前没有截断，不属于损坏
+			if err == io.EOF && isActive {
+				truncated, err := db.truncateZeroTail(dataFile, offset, fileSize)
+				if err != nil {
+					file.err = err
+					return file
+				}
+				if truncated {
+					break
+				}
+			}
+			//没有读到文件末尾，说明数据损坏，根据恢复策略处理
+			next, err := db.recoverDataFile(&file.recovery, dataFile, offset, fileSize, err, isActive)
+			if err != nil {
+				file.err = err
+				return file
+			}
+			if next < 0 {
+				break
+			}
+			offset = next
+			continue
+		}
+
+		//Key 和 Value 在同一块内存中，拷贝 Key 以免暂存期间一直持有 Value
+		file.entries = append(file.entries, &hintEntry{
+			key: append([]byte(nil), logRecord.Key...),
+			typ: logRecord.Type,
+			pos: &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size), ExpireAt: logRecord.ExpireAt},
+		})
+
+		//递增offset到下一个Entry
+		offset += size
+	}
+	file.writeoff = offset
+	return file
+}
@@ -0,0 +1,111 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_LoadConcurrency(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%300), utils.RandomValue(16)))
+		if i%7 == 0 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i%300/2)))
+		}
+		//跨越多个数据文件的批次
+		if i%250 == 0 {
+			wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+			for j := 0; j < 100; j++ {
+				assert.Nil(t, wb.Put(utils.GetTestKey(300+j), utils.RandomValue(16)))
+			}
+			assert.Nil(t, wb.Commit())
+		}
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("ttl"), []byte("value"), time.Hour))
+	assert.Nil(t, db.PutWithTTL([]byte("expired"), []byte("value"), time.Millisecond))
+	expected := make(map[string][]byte)
+	assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+		expected[string(key)] = value
+		return true
+	}))
+	stat := db.Stat()
+	assert.Greater(t, int(stat.DataFileNum), 20)
+	assert.Nil(t, db.Close())
+	time.Sleep(2 * time.Millisecond)
+	delete(expected, "expired")
+
+	//一部分文件从 Hint 加载，一部分扫描数据文件
+	for fid := uint32(0); fid < 10; fid += 2 {
+		assert.Nil(t, os.Remove(data.GetHintFileName(dir, fid)))
+	}
+
+	for _, concurrency := range []int{0, 1, 3, 16} {
+		opts.LoadConcurrency = concurrency
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, len(expected), len(db2.ListKeys()))
+		for key, value := range expected {
+			val, err := db2.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		stat2 := db2.Stat()
+		assert.Equal(t, stat.DataFileNum, stat2.DataFileNum)
+		assert.Equal(t, stat.Files[:len(stat.Files)-1], stat2.Files[:len(stat2.Files)-1])
+		assert.Nil(t, db2.Close())
+	}
+
+	opts.LoadConcurrency = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_LoadConcurrencyCorruptOlderFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	assert.Nil(t, db.Close())
+
+	//破坏第一个旧文件，活跃文件尾部写入半条数据
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[data.FileHeaderSize+1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	assert.Nil(t, os.Remove(data.GetHintFileName(dir, 0)))
+	activeName := data.GetDataFileName(dir, db.activefile.FileId)
+	file, err := os.OpenFile(activeName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("torn"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	info, err := os.Stat(activeName)
+	assert.Nil(t, err)
+
+	//旧文件损坏时启动失败，活跃文件不会被截断
+	opts.LoadConcurrency = 8
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCrc, err)
+	info2, err := os.Stat(activeName)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), info2.Size())
+}
@@ -2,26 +2,85 @@ package bitcaskkvdb
 
 import (
 	"bitcask/data"
+	"bitcask/fio"
 	"bitcask/utils"
+	"context"
 	"io"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	mergeDirName     = "-merge"
 	mergeFinishedKey = "merge.finished"
+	mergeFilesKey    = "merge.files"
+
+	//在线应用 Merge 结果时每次持有锁更新的索引条数
+	mergeApplyBatchSize = 1024
 )
 
-// Merge 清理无效数据，生成HINT文件
+// 一次 Merge 的执行状态
+type mergeJob struct {
+	files          []*data.DataFile    //参与 Merge 的数据文件，按id从小到大排序
+	fileIds        map[uint32]struct{} //参与 Merge 的数据文件id
+	mergeBase      uint32              //Merge 生成的数据文件的起始id
+	nonMergeFileId uint32              //第一个没有参与 Merge 文件的ID
+	minUnmerged    uint32              //没有参与 Merge 的最小旧文件id，比它新的文件中的墓碑需要保留
+	expiredKeys    [][]byte            //没有被重写的过期key
+	deadBytes      map[uint32]int64    //重写到新文件中的无效数据（保留的墓碑）
+	progress       MergeProgress       //执行进度
+}
+
+// MergeProgress Merge 的执行进度，每处理完一个文件以及 Merge 完成时回调
+type MergeProgress struct {
+	FilesTotal     int   //参与 Merge 的文件个数
+	FilesProcessed int   //已经处理完的文件个数
+	BytesRewritten int64 //重写到新文件中的字节数
+	BytesReclaimed int64 //回收的磁盘空间，Merge 完成时才会更新
+
+	TombstonesDropped int //被彻底清理的墓碑个数
+	TombstonesKept    int //需要保留而被重写的墓碑个数（包括过期数据转换成的墓碑）
+
+	Finished bool //是否已经完成
+}
+
+func (job *mergeJob) contains(fid uint32) bool {
+	_, ok := job.fileIds[fid]
+	return ok
+}
+
+// 判断数据文件中已经被删除的key是否需要保留墓碑
+// 墓碑只会遮盖比它更旧的数据：所有更旧的文件都参与了 Merge 时，被删除key的旧数据一定不会被重写，墓碑可以丢弃；
+// 否则没有参与 Merge 的旧文件中可能还有该key的数据，丢弃墓碑会让它在重启之后复活。
+// 比 nonMergeFileId 更新的文件不参与 Merge，其中的墓碑总是原样保留
+func (job *mergeJob) needTombstone(fid uint32) bool {
+	return job.minUnmerged < fid
+}
+
+// Merge 清理无效数据，生成HINT文件，并在不重启的情况下用新的数据文件替换旧的数据文件
+//
+// Merge 生成的数据文件使用为其预留的文件id [mergeBase, nonMergeFileId)，
+// 和现有的文件id不冲突，所以任何位置索引始终只对应一个数据文件
+//
+// 配置了 SelectiveMergeRatio 时只重写无效数据比例达到该值的文件
 func (db *DB) Merge() error {
+	return db.MergeWithOptions(context.Background(), MergeOptions{})
+}
+
+// MergeWithOptions 执行 Merge，可以通过 ctx 取消、限制读写速度并获取执行进度
+// 在生成新的数据文件之前被取消时，会清理掉 Merge 目录
+func (db *DB) MergeWithOptions(ctx context.Context, opts MergeOptions) error {
+	db.mu.Lock()
 	if db.activefile == nil {
+		db.mu.Unlock()
 		return nil
 	}
-	db.mu.Lock()
 
 	//如果正在Merge,返回
 	if db.isMerging {
@@ -29,65 +88,157 @@ func (db *DB) Merge() error {
 		return ErrMergeIsProgress
 	}
 
-	//查看可以merge的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.options.Dirpath)
+	job, err := db.prepareMerge()
 	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	if float32(db.DeletedSize)/float32(totalSize) < db.options.DataFileMergeRatio {
+	db.isMerging = true
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
 		db.mu.Unlock()
-		return ErrNotOverMergeRatio
-	}
+	}()
+	db.mu.Unlock()
 
-	//查看剩余的空间容量是否可以容纳merge之后的数据量
-	avilableDiskSize, err := utils.AvailableDiskSize()
+	job.progress.FilesTotal = len(job.files)
+	err = db.mergeToDir(ctx, job, opts)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
-		db.mu.Unlock()
+		//Merge 目录中的数据还没有生效，直接清理掉
+		_ = os.RemoveAll(db.getMergePath())
 		return err
 	}
-	if totalSize-db.DeletedSize >= int64(avilableDiskSize) {
-		db.mu.Unlock()
-		return ErrNoEnoughSpaceForMerge
+	if err := db.applyMerge(job); err != nil {
+		return err
 	}
 
-	db.isMerging = true
-	defer func() {
-		db.isMerging = false
-	}()
+	job.progress.Finished = true
+	if opts.Progress != nil {
+		opts.Progress(job.progress)
+	}
+	return nil
+}
 
-	//0 1 [2]-> (0 1 2) [3]
-	//关闭当前的活跃文件
-	if err := db.activefile.Sync(); err != nil {
-		db.mu.Unlock()
-		return err
+// 限制 Merge 的平均读写速度
+type mergeLimiter struct {
+	bytesPerSec int64
+	start       time.Time
+	bytes       int64
+}
+
+// 累计读写的字节数，超过限制时等待，等待期间可以被 ctx 取消
+func (l *mergeLimiter) wait(ctx context.Context, n int64) error {
+	if l.bytesPerSec <= 0 {
+		return ctx.Err()
+	}
+	l.bytes += n
+	expected := time.Duration(float64(l.bytes) / float64(l.bytesPerSec) * float64(time.Second))
+	delay := expected - time.Since(l.start)
+	//等待时间太短时先累积，避免频繁休眠
+	if delay < 10*time.Millisecond {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	db.olderfile[db.activefile.FileId] = db.activefile
+}
 
-	//打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
-		db.mu.Unlock()
-		return err
+// 选出参与 Merge 的数据文件，并打开新的活跃文件
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) prepareMerge() (*mergeJob, error) {
+	candidates := make([]*data.DataFile, 0, len(db.olderfile)+1)
+	for _, file := range db.olderfile {
+		candidates = append(candidates, file)
 	}
+	candidates = append(candidates, db.activefile)
 
-	//记录第一个没有参与 Merge 文件的ID
-	nonMergeFileId := db.activefile.FileId
+	var totalSize, mergeSize, mergeDeadSize int64
+	var staleKey bool
+	job := &mergeJob{
+		fileIds:     make(map[uint32]struct{}),
+		minUnmerged: math.MaxUint32,
+		deadBytes:   make(map[uint32]int64),
+	}
+	for _, file := range candidates {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		totalSize += size
+		//没有使用当前密钥加密的文件总是需要重写，以完成密钥轮换
+		keyMatches, err := file.KeyMatches(db.options.EncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+		staleKey = staleKey || !keyMatches
+		ratio := db.options.SelectiveMergeRatio
+		if ratio > 0 && keyMatches && (size == 0 || float32(file.DeadSize)/float32(size) < ratio) {
+			job.minUnmerged = min(job.minUnmerged, file.FileId)
+			continue
+		}
+		job.files = append(job.files, file)
+		job.fileIds[file.FileId] = struct{}{}
+		mergeSize += size
+		mergeDeadSize += file.DeadSize
+	}
 
-	var MergeFiles []*data.DataFile
-	for _, file := range db.olderfile {
-		MergeFiles = append(MergeFiles, file)
+	//查看可以merge的数据量是否达到了阈值
+	if db.options.SelectiveMergeRatio > 0 {
+		if len(job.files) == 0 {
+			return nil, ErrNotOverMergeRatio
+		}
+	} else if !staleKey && (totalSize == 0 || float32(db.DeletedSize)/float32(totalSize) < db.options.DataFileMergeRatio) {
+		return nil, ErrNotOverMergeRatio
+	}
+
+	//查看剩余的空间容量是否可以容纳merge之后的数据量
+	avilableDiskSize, err := utils.AvailableDiskSize()
+	if err != nil {
+		return nil, err
+	}
+	if mergeSize-mergeDeadSize >= int64(avilableDiskSize) {
+		return nil, ErrNoEnoughSpaceForMerge
+	}
+
+	//0 1 [2]-> (0 1 2) 3 4 5 [6]
+	//关闭当前的活跃文件
+	if err := db.sealActiveFile(); err != nil {
+		return nil, err
+	}
+	//旧文件可能在 sealActiveFile 中被重新映射，使用最新的 DataFile
+	for i, file := range job.files {
+		job.files[i] = db.olderfile[file.FileId]
 	}
-	db.mu.Unlock()
+
+	//Merge 之后的数据量不会超过参与 Merge 的数据，文件个数也不会更多，
+	//为其预留 len(job.files) 个文件id，新的活跃文件跳过这些id
+	job.mergeBase = db.activefile.FileId + 1
+	if err := db.openActiveDataFile(job.mergeBase + uint32(len(job.files))); err != nil {
+		return nil, err
+	}
+	job.nonMergeFileId = db.activefile.FileId
 
 	//将需要Merge的文件从小到大排序，依次Merge
-	sort.Slice(MergeFiles, func(i, j int) bool {
-		return MergeFiles[i].FileId < MergeFiles[j].FileId
+	sort.Slice(job.files, func(i, j int) bool {
+		return job.files[i].FileId < job.files[j].FileId
 	})
+	return job, nil
+}
 
+// 将参与 Merge 的数据文件中的有效数据重写到 Merge 目录中
+func (db *DB) mergeToDir(ctx context.Context, job *mergeJob, opts MergeOptions) error {
 	mergePath := db.getMergePath()
 
 	//如果目录存在，说明发生过 Merge，将其删除掉
-	if _, err := os.Stat(mergePath); err != nil {
+	if _, err := os.Stat(mergePath); err == nil {
 		if err := os.RemoveAll(mergePath); err != nil {
 			return err
 		}
@@ -102,38 +253,77 @@ func (db *DB) Merge() error {
 	mergeOpts := db.options
 	mergeOpts.Dirpath = mergePath
 	mergeOpts.SyncWrites = false
+	mergeOpts.AutoMergeInterval = 0
+	//临时实例的索引不会被使用，避免生成 B+树索引文件覆盖数据目录中的索引
+	mergeOpts.IndexType = Btree
+	//临时实例关闭时不能写出索引快照，否则会在 Merge 完成后被当作数据目录的快照加载
+	mergeOpts.IndexSnapshot = false
+	mergeOpts.IndexSnapshotInterval = 0
 	mergeDB, err := Open(mergeOpts)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
+
+	//从预留的文件id开始写入
+	if err := mergeDB.openActiveDataFile(job.mergeBase); err != nil {
+		return err
+	}
 
 	//打开Hint文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(mergePath, db.options.EncryptionKeys)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 
 	//遍历处理每个数据文件
-	for _, datafile := range MergeFiles {
-		var offset int64 = 0
+	now := time.Now().UnixNano()
+	limiter := &mergeLimiter{bytesPerSec: opts.RateLimitBytesPerSec, start: time.Now()}
+	keptTombstones := make(map[string]struct{}) //同一个key只需要保留一条墓碑
+	for _, datafile := range job.files {
+		keepTombstones := job.needTombstone(datafile.FileId)
+
+		fileSize, err := datafile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+
+		var offset = datafile.DataOffset()
 		for {
 			logrecord, size, err := datafile.ReadRecord(offset)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
+				//启动时已经跳过的损坏数据，Merge 时同样跳过
+				if db.options.RecoveryMode == RecoverSkipCorrupt {
+					if offset = findNextRecord(datafile, offset+1, fileSize); offset >= 0 {
+						continue
+					}
+					break
+				}
 				return err
 			}
 			//解析拿到内存中实际的Key
 			realKey, _ := parseLogRecordKey(logrecord.Key)
 			logrecordPos := db.index.Get(realKey)
+			offset += size
+			if err := limiter.wait(ctx, size); err != nil {
+				return err
+			}
 
-			//和内存中的索引进行比较，如果有效就重写
-			if logrecordPos != nil &&
+			//和内存中的索引进行比较，如果有效且没有过期就重写
+			isCurrent := logrecordPos != nil &&
 				logrecordPos.Fid == datafile.FileId &&
-				logrecordPos.Offset == offset {
+				logrecordPos.Offset == offset-size
+			if isCurrent && !logrecordPos.Expired(now) {
 				//如果有效，即在内存，则不需要事务序列号
 				logrecord.Key = LogRecordKeyWithSeq(realKey, NonTransactionSewNo)
+				//按照当前的配置重新压缩，修改压缩算法之后旧数据在 Merge 时转换
+				logrecord.Compression = db.options.Compression
 				//重写进Merge实例的ActiveFile
 				pos, err := mergeDB.appendLogRecord(logrecord)
 				if err != nil {
@@ -143,10 +333,49 @@ func (db *DB) Merge() error {
 				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
 					return err
 				}
+				job.progress.BytesRewritten += int64(pos.Size)
+				if err := limiter.wait(ctx, int64(pos.Size)); err != nil {
+					return err
+				}
+				continue
 			}
-			//增加Offset
-			offset += size
+			if isCurrent {
+				job.expiredKeys = append(job.expiredKeys, realKey)
+			}
+
+			//墓碑对应的key在内存索引中存在，说明之后又被重新写入，墓碑已经无效
+			isTombstone := logrecord.Type == data.LogRecordDeleted
+			needKeep := keepTombstones && ((isTombstone && logrecordPos == nil) || isCurrent)
+			if _, kept := keptTombstones[string(realKey)]; !needKeep || kept {
+				if isTombstone {
+					job.progress.TombstonesDropped++
+				}
+				continue
+			}
+
+			//已经被删除或者过期的key，以墓碑的形式保留
+			keptTombstones[string(realKey)] = struct{}{}
+			job.progress.TombstonesKept++
+			pos, err := mergeDB.appendLogRecord(&data.LogRecord{
+				Key:  LogRecordKeyWithSeq(realKey, NonTransactionSewNo),
+				Type: data.LogRecordDeleted,
+			})
+			if err != nil {
+				return err
+			}
+			job.deadBytes[pos.Fid] += int64(pos.Size)
+			job.progress.BytesRewritten += int64(pos.Size)
 		}
+
+		job.progress.FilesProcessed++
+		if opts.Progress != nil {
+			opts.Progress(job.progress)
+		}
+	}
+
+	//预留的文件id不够用时放弃本次 Merge，避免和新的活跃文件冲突
+	if mergeDB.activefile.FileId >= job.nonMergeFileId {
+		return ErrMergeFileIdExhausted
 	}
 
 	// sync持久化
@@ -161,19 +390,198 @@ func (db *DB) Merge() error {
 	if err != nil {
 		return err
 	}
+	defer mergeFinshedFile.Close()
 	//写入没有被merge的第一个文件
 	mergeFinRecord := &data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+		Value: []byte(strconv.Itoa(int(job.nonMergeFileId))),
+	}
+
+	//写入参与 Merge 的文件id，重启时只删除这些旧文件
+	fileIds := make([]string, 0, len(job.files))
+	for _, datafile := range job.files {
+		fileIds = append(fileIds, strconv.Itoa(int(datafile.FileId)))
+	}
+	mergeFilesRecord := &data.LogRecord{
+		Key:   []byte(mergeFilesKey),
+		Value: []byte(strings.Join(fileIds, ",")),
 	}
 
-	encRecord, _ := data.Encode_LogRecord(mergeFinRecord)
-	if err := mergeFinshedFile.Write(encRecord); err != nil {
+	for _, record := range []*data.LogRecord{mergeFinRecord, mergeFilesRecord} {
+		encRecord, _ := data.Encode_LogRecord(record)
+		if err := mergeFinshedFile.Write(encRecord); err != nil {
+			return err
+		}
+	}
+	return mergeFinshedFile.Sync()
+}
+
+// 在线应用 Merge 结果：移入新的数据文件，更新内存索引，再淘汰旧的数据文件
+// 每一步都可以在重启时由 loadMergeFiles 继续完成
+func (db *DB) applyMerge(job *mergeJob) error {
+	mergePath := db.getMergePath()
+	db.indexSnapshotMu.Lock()
+	defer db.indexSnapshotMu.Unlock()
+
+	//不持有锁时打开新的数据文件并读取Hint文件，文件移动到数据目录之后已经打开的文件仍然有效
+	mergedFiles, err := db.openMergedFiles(mergePath, job)
+	if err != nil {
+		return err
+	}
+	hints, err := readMergeHints(mergePath, db.options.EncryptionKeys)
+	if err != nil {
+		for _, dataFile := range mergedFiles {
+			_ = dataFile.Close()
+		}
 		return err
 	}
-	if err := mergeFinshedFile.Sync(); err != nil {
+
+	//将 Merge 生成的数据文件和Hint文件移动到数据目录中，此后新旧数据文件都可以读取
+	db.mu.Lock()
+	err = db.installMergedFiles(mergePath, mergedFiles)
+	db.mu.Unlock()
+	if err != nil {
+		//已经移动的文件在重启时由 loadMergeFiles 继续处理
+		for _, dataFile := range mergedFiles {
+			_ = dataFile.Close()
+		}
 		return err
 	}
+
+	//分批更新内存索引，批次之间释放锁，Merge 期间以及更新期间被修改或删除的key保持不变
+	for start := 0; start < len(hints); start += mergeApplyBatchSize {
+		end := min(start+mergeApplyBatchSize, len(hints))
+		db.mu.Lock()
+		for _, hint := range hints[start:end] {
+			if pos := db.index.Get(hint.key); pos != nil && job.contains(pos.Fid) {
+				db.saveSnapshotPosLocked(hint.key)
+				db.index.Put(hint.key, hint.pos)
+			} else if dataFile := db.olderfile[hint.pos.Fid]; dataFile != nil {
+				//重写之后又被修改的数据已经无效
+				dataFile.DeadSize += int64(hint.pos.Size)
+			}
+		}
+		db.mu.Unlock()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	//过期的数据没有被重写，从索引中删除
+	for _, key := range job.expiredKeys {
+		if pos := db.index.Get(key); pos != nil && job.contains(pos.Fid) {
+			db.saveSnapshotPosLocked(key)
+			db.index.Delete(key)
+		}
+	}
+
+	//淘汰旧的数据文件，正在被读取或者被快照引用的文件在引用释放后才会关闭
+	for _, dataFile := range job.files {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		job.progress.BytesReclaimed += size
+		if err := os.Remove(data.GetDataFileName(db.options.Dirpath, dataFile.FileId)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := removeHintFile(db.options.Dirpath, dataFile.FileId); err != nil {
+			return err
+		}
+		delete(db.olderfile, dataFile.FileId)
+		dataFile.Retire()
+	}
+
+	//旧文件中的无效数据已经被清理，重新统计
+	db.DeletedSize = db.activefile.DeadSize
+	for _, dataFile := range db.olderfile {
+		db.DeletedSize += dataFile.DeadSize
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// 打开 Merge 目录中生成的数据文件
+func (db *DB) openMergedFiles(mergePath string, job *mergeJob) ([]*data.DataFile, error) {
+	dirEntries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return nil, err
+	}
+	ioType := fio.StandardFio
+	if db.options.MMapSealedFiles {
+		ioType = fio.MemoryMap
+	}
+	var mergedFiles []*data.DataFile
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.Split(name, ".")[0])
+		if err == nil {
+			var dataFile *data.DataFile
+			if dataFile, err = data.OpenDataFile(mergePath, uint32(fileId), ioType, db.options.EncryptionKeys); err == nil {
+				mergedFiles = append(mergedFiles, dataFile)
+				dataFile.DeadSize = job.deadBytes[uint32(fileId)]
+				var size int64
+				size, err = dataFile.IoManager.Size()
+				job.progress.BytesReclaimed -= size
+			}
+		}
+		if err != nil {
+			for _, dataFile := range mergedFiles {
+				_ = dataFile.Close()
+			}
+			return nil, err
+		}
+	}
+	return mergedFiles, nil
+}
+
+// 读取 Merge 生成的Hint文件中所有数据的新位置
+func readMergeHints(mergePath string, keys data.KeyProvider) ([]hintEntry, error) {
+	hintFile, err := data.OpenHintFile(mergePath, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer hintFile.Close()
+	var hints []hintEntry
+	var offset = hintFile.DataOffset()
+	for {
+		logRecord, size, err := hintFile.ReadRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		hints = append(hints, hintEntry{key: logRecord.Key, pos: data.DecodeLogRecordPos(logRecord.Value)})
+		offset += size
+	}
+	return hints, nil
+}
+
+// 移动 Merge 生成的数据文件和Hint文件，并加入到旧文件中
+// （在访问此方法前必须持有互斥锁）
+func (db *DB) installMergedFiles(mergePath string, mergedFiles []*data.DataFile) error {
+	//索引快照中的数据位置在 Merge 之后失效
+	if err := removeIndexSnapshot(db.options.Dirpath); err != nil {
+		return err
+	}
+	dirEntries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if name != data.HintFileName && !strings.HasSuffix(name, data.HintFileNameSuffix) && !strings.HasSuffix(name, data.DataFileNameSuffix) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(mergePath, name), filepath.Join(db.options.Dirpath, name)); err != nil {
+			return err
+		}
+	}
+	for _, dataFile := range mergedFiles {
+		db.olderfile[dataFile.FileId] = dataFile
+	}
 	return nil
 }
 
@@ -208,7 +616,8 @@ func (db *DB) loadMergeFiles() error {
 		if entry.Name() == data.MergeFinishedFileName {
 			mergeFinished = true
 		}
-		if entry.Name() == data.SeqNoFileName {
+		if entry.Name() == data.SeqNoFileName || entry.Name() == data.SeqNoTmpFileName ||
+			entry.Name() == data.IndexSnapshotFileName {
 			continue
 		}
 		if entry.Name() == fileLockName {
@@ -222,21 +631,28 @@ func (db *DB) loadMergeFiles() error {
 		return nil
 	}
 
-	//取出最近 NonMerge Fileid
-	NonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	//取出参与 Merge 的旧数据文件id
+	mergedFileIds, err := db.getMergedFileIds(mergePath)
 	if err != nil {
 		return err
 	}
 
-	//删除旧的数据文件(FileId < NonMergeFileId)
-	var fileId uint32 = 0
-	for ; fileId < NonMergeFileId; fileId++ {
+	//索引快照中的数据位置在 Merge 之后失效
+	if err := removeIndexSnapshot(db.options.Dirpath); err != nil {
+		return err
+	}
+
+	//删除旧的数据文件
+	for _, fileId := range mergedFileIds {
 		fileName := data.GetDataFileName(db.options.Dirpath, fileId)
 		if _, err := os.Stat(fileName); err == nil {
 			if err := os.Remove(fileName); err != nil {
 				return err
 			}
 		}
+		if err := removeHintFile(db.options.Dirpath, fileId); err != nil {
+			return err
+		}
 	}
 
 	//将新的数据文件移动过来
@@ -257,7 +673,7 @@ func (db *DB) getNonMergeFileId(dirpath string) (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
-	record, _, err := mergeFinishedFile.ReadRecord(0)
+	record, _, err := mergeFinishedFile.ReadRecord(mergeFinishedFile.DataOffset())
 	if err != nil {
 		return 0, err
 	}
@@ -269,6 +685,43 @@ func (db *DB) getNonMergeFileId(dirpath string) (uint32, error) {
 	return uint32(res), nil
 }
 
+// 取出参与 Merge 的旧数据文件id，旧版本的 Merge 记录中没有文件列表，参与 Merge 的是 NonMergeFileId 之前所有的文件
+func (db *DB) getMergedFileIds(dirpath string) ([]uint32, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	defer mergeFinishedFile.Close()
+	record, size, err := mergeFinishedFile.ReadRecord(mergeFinishedFile.DataOffset())
+	if err != nil {
+		return nil, err
+	}
+
+	var fileIds []uint32
+	filesRecord, _, err := mergeFinishedFile.ReadRecord(mergeFinishedFile.DataOffset() + size)
+	if err == io.EOF {
+		nonMergeFileId, err := strconv.Atoi(string(record.Value))
+		if err != nil {
+			return nil, err
+		}
+		for fid := 0; fid < nonMergeFileId; fid++ {
+			fileIds = append(fileIds, uint32(fid))
+		}
+		return fileIds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(string(filesRecord.Value), ",") {
+		fid, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, err
+		}
+		fileIds = append(fileIds, uint32(fid))
+	}
+	return fileIds, nil
+}
+
 func (db *DB) loadIndexFromHintFile() error {
 	//查看Hint文件是否存在
 	hintFileName := filepath.Join(db.options.Dirpath, data.HintFileName)
@@ -277,13 +730,13 @@ func (db *DB) loadIndexFromHintFile() error {
 	}
 
 	//打开Hint索引文件<key,pos>
-	hintFile, err := data.OpenHintFile(db.options.Dirpath)
+	hintFile, err := data.OpenHintFile(db.options.Dirpath, db.options.EncryptionKeys)
 	if err != nil {
 		return err
 	}
 
 	//读取文件中的索引
-	var offset int64 = 0
+	var offset = hintFile.DataOffset()
 	for {
 		logRecord, size, err := hintFile.ReadRecord(offset)
 		if err != nil {
@@ -0,0 +1,102 @@
+package bitcaskkvdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 进程内正在进行的自动 Merge 个数，所有数据库实例共享
+var runningAutoMerges int32
+
+// MergeResult 最近一次自动 Merge 的执行结果
+type MergeResult struct {
+	StartTime time.Time     //开始时间
+	Duration  time.Duration //耗时
+	Err       error         //执行失败时的错误
+}
+
+// 启动后台自动 Merge 协程
+func (db *DB) startAutoMerge() {
+	if db.options.AutoMergeInterval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	db.mergeCancel = cancel
+	db.mergeWg = new(sync.WaitGroup)
+	db.mergeWg.Add(1)
+	go db.runAutoMerge(ctx)
+}
+
+// 停止后台自动 Merge 协程，取消正在进行的 Merge 并等待其退出
+func (db *DB) stopAutoMerge() {
+	if db.mergeCancel == nil {
+		return
+	}
+	db.mergeCancel()
+	db.mergeWg.Wait()
+	db.mergeCancel = nil
+}
+
+func (db *DB) runAutoMerge(ctx context.Context) {
+	defer db.mergeWg.Done()
+
+	ticker := time.NewTicker(db.options.AutoMergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !inMergeWindow(now, db.options.AutoMergeWindowStart, db.options.AutoMergeWindowEnd) {
+				continue
+			}
+			if !acquireMergeSlot(db.options.MaxConcurrentMerges) {
+				continue
+			}
+			start := time.Now()
+			err := db.MergeWithOptions(ctx, MergeOptions{})
+			atomic.AddInt32(&runningAutoMerges, -1)
+			if ctx.Err() != nil {
+				return
+			}
+
+			//无效数据未达到阈值或者已经在 Merge 都不算一次执行
+			if err == ErrNotOverMergeRatio || err == ErrMergeIsProgress {
+				continue
+			}
+			db.mu.Lock()
+			db.lastAutoMerge = MergeResult{StartTime: start, Duration: time.Since(start), Err: err}
+			db.autoMergeRuns++
+			db.mu.Unlock()
+		}
+	}
+}
+
+// 占用一个自动 Merge 名额，名额已满时返回 false
+func acquireMergeSlot(max int) bool {
+	for {
+		running := atomic.LoadInt32(&runningAutoMerges)
+		if max > 0 && int(running) >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&runningAutoMerges, running, running+1) {
+			return true
+		}
+	}
+}
+
+// 判断当前时间是否处于允许 Merge 的时间窗口中
+func inMergeWindow(now time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	year, month, day := now.Date()
+	sinceMidnight := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+	if start < end {
+		return sinceMidnight >= start && sinceMidnight < end
+	}
+	//时间窗口跨越零点
+	return sinceMidnight >= start || sinceMidnight < end
+}
@@ -0,0 +1,66 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.AutoMergeInterval = 20 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	//等待后台至少完成一次 Merge
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stat().AutoMergeRuns == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stat := db.Stat()
+	assert.NotEqual(t, uint(0), stat.AutoMergeRuns)
+	assert.Nil(t, stat.LastAutoMerge.Err)
+	assert.False(t, stat.LastAutoMerge.StartTime.IsZero())
+
+	//关闭之后后台协程退出
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.mergeCancel)
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+}
+
+func TestInMergeWindow(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+
+	//不限制时间窗口
+	assert.True(t, inMergeWindow(day.Add(13*time.Hour), 0, 0))
+
+	//凌晨 2 点到 5 点
+	assert.True(t, inMergeWindow(day.Add(3*time.Hour), 2*time.Hour, 5*time.Hour))
+	assert.False(t, inMergeWindow(day.Add(5*time.Hour), 2*time.Hour, 5*time.Hour))
+
+	//晚上 22 点到凌晨 4 点，跨越零点
+	assert.True(t, inMergeWindow(day.Add(23*time.Hour), 22*time.Hour, 4*time.Hour))
+	assert.True(t, inMergeWindow(day.Add(1*time.Hour), 22*time.Hour, 4*time.Hour))
+	assert.False(t, inMergeWindow(day.Add(12*time.Hour), 22*time.Hour, 4*time.Hour))
+}
@@ -2,9 +2,12 @@ package bitcaskkvdb
 
 import (
 	"bitcask/utils"
+	"context"
+	"fmt"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -98,3 +101,425 @@ func TestWriteWhileMerge(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+func TestDB_MergeOnline(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.PutWithTTL(utils.GetTestKey(1), []byte("expired"), time.Nanosecond)
+	assert.Nil(t, err)
+
+	snap := db.Snapshot()
+	iter := db.NewIterator(DefalutIteratorOptions)
+	before := db.Stat()
+
+	//Merge 期间并发读取不受影响
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1500; ; i = 1500 + (i+1)%500 {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+	}()
+	err = db.Merge()
+	assert.Nil(t, err)
+	close(stop)
+	wg.Wait()
+
+	//不需要重启，旧的数据文件已经被删除，磁盘空间被回收
+	after := db.Stat()
+	assert.Less(t, after.DataFileNum, before.DataFileNum)
+	assert.Less(t, after.DiskSize, before.DiskSize)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i < 1500 {
+			assert.Equal(t, ErrKeyNotFind, err)
+		} else {
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+	assert.Equal(t, 500, len(db.ListKeys()))
+
+	//Merge 之前创建的快照和迭代器依然可以读取旧的数据文件
+	val, err := snap.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		_, err := iter.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 500, count)
+	iter.Close()
+	snap.Release()
+
+	//Merge 之后继续写入，重启后数据一致
+	err = db.Put(utils.GetTestKey(0), []byte("after merge"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db2.ListKeys()))
+	val, err = db2.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after merge"), val)
+	_, err = db2.Get(utils.GetTestKey(1999))
+	assert.Equal(t, ErrKeyNotFind, err)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFind, err)
+}
+
+func TestDB_FileGarbageStat(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefalutWriteBatchOptions)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	//每个文件的无效数据之和等于总的无效数据
+	stat := db.Stat()
+	var deadSize int64
+	for _, file := range stat.Files {
+		assert.True(t, file.DeadSize <= file.LiveSize+file.DeadSize)
+		deadSize += file.DeadSize
+	}
+	assert.Equal(t, stat.DeletedSize, deadSize)
+	assert.Greater(t, stat.Files[0].DeadSize, int64(0))
+
+	//重启之后从数据文件中恢复出相同的统计
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, stat.DeletedSize, db2.Stat().DeletedSize)
+	assert.Equal(t, stat.Files, db2.Stat().Files)
+}
+
+func TestDB_SelectiveMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.SelectiveMergeRatio = 0.5
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//前面的文件基本都是有效数据
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	coldFiles := db.Stat().Files
+
+	//后面的文件基本都是被覆盖的数据，以及删除前面文件中key的墓碑
+	for i := 0; i < 2000; i++ {
+		err := db.Put([]byte("hot"), utils.RandomValue(128))
+		assert.Nil(t, err)
+		if i%100 == 0 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i/100)))
+		}
+	}
+	assert.Nil(t, db.Put([]byte("hot"), []byte("last")))
+
+	before := db.Stat()
+	var progress MergeProgress
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		Progress: func(p MergeProgress) { progress = p },
+	})
+	assert.Nil(t, err)
+	after := db.Stat()
+	assert.Less(t, after.DiskSize, before.DiskSize)
+	assert.Less(t, after.DeletedSize, before.DeletedSize)
+
+	//被删除key的旧数据在没有参与 Merge 的文件中，墓碑必须保留
+	assert.Greater(t, progress.TombstonesKept, 0)
+	assert.Equal(t, 0, progress.TombstonesDropped)
+
+	//有效数据比例高的旧文件没有被重写
+	remaining := make(map[uint32]bool)
+	for _, file := range after.Files {
+		remaining[file.FileId] = true
+	}
+	for _, file := range coldFiles[:len(coldFiles)-1] {
+		assert.True(t, remaining[file.FileId])
+	}
+
+	check := func(db *DB) {
+		val, err := db.Get([]byte("hot"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("last"), val)
+		for i := 0; i < 1000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i < 20 {
+				assert.Equal(t, ErrKeyNotFind, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+	}
+	check(db)
+
+	//墓碑被保留下来，重启之后被删除的key不会复活
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+
+	//没有文件达到阈值
+	assert.Equal(t, ErrNotOverMergeRatio, db2.Merge())
+}
+
+func TestDB_MergeWithOptions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	//处理完第一个文件之后取消，Merge 目录被清理，数据不受影响
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.MergeWithOptions(ctx, MergeOptions{
+		Progress: func(p MergeProgress) {
+			cancel()
+		},
+	})
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 1000, len(db.ListKeys()))
+
+	//限制读写速度，并记录执行进度
+	var progress []MergeProgress
+	start := time.Now()
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		RateLimitBytesPerSec: 1024 * 1024,
+		Progress: func(p MergeProgress) {
+			progress = append(progress, p)
+		},
+	})
+	assert.Nil(t, err)
+	last := progress[len(progress)-1]
+	assert.True(t, last.Finished)
+	assert.Equal(t, last.FilesTotal, last.FilesProcessed)
+	assert.Equal(t, last.FilesTotal+1, len(progress))
+	assert.Greater(t, last.BytesRewritten, int64(0))
+	assert.Greater(t, last.BytesReclaimed, int64(0))
+
+	//读取和重写的数据超过 300KB，按照 1MB/s 的速度至少需要 300ms
+	assert.Greater(t, time.Since(start), 250*time.Millisecond)
+
+	for i := 1000; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_MergeTombstones(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 200; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	//Merge 期间的删除和写入落在 nonMergeFileId 之后的文件中
+	var progress MergeProgress
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		Progress: func(p MergeProgress) {
+			if p.FilesProcessed == 1 && !p.Finished {
+				for i := 200; i < 300; i++ {
+					assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+				}
+				for i := 300; i < 310; i++ {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("during merge")))
+				}
+			}
+			progress = p
+		},
+	})
+	assert.Nil(t, err)
+
+	//所有旧文件都参与了 Merge，之前的墓碑可以全部丢弃
+	assert.Equal(t, 200, progress.TombstonesDropped)
+	assert.Equal(t, 0, progress.TombstonesKept)
+
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 300:
+				assert.Equal(t, ErrKeyNotFind, err)
+			case i < 310:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("during merge"), val)
+			default:
+				assert.Nil(t, err)
+			}
+		}
+		assert.Equal(t, 700, len(db.ListKeys()))
+	}
+	check(db)
+
+	//重启之后被删除的key不会复活
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+
+	//再次 Merge，Merge 期间写入的墓碑也被清理
+	progress = MergeProgress{}
+	err = db2.MergeWithOptions(context.Background(), MergeOptions{
+		Progress: func(p MergeProgress) { progress = p },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, progress.TombstonesDropped)
+	check(db2)
+
+	assert.Nil(t, db2.Close())
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	check(db3)
+}
+
+// 分批更新索引期间并发的写入和删除，Merge 完成之后保持最新的结果
+func TestDB_MergeApplyWithConcurrentWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	const keys = 5 * mergeApplyBatchSize
+	expected := make(map[int][]byte, keys)
+	for i := 0; i < keys; i++ {
+		value := utils.RandomValue(32)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		expected[i] = value
+	}
+
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; ; round++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			i := round * 7 % keys
+			if round%3 == 0 {
+				assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+				delete(expected, i)
+			} else {
+				value := []byte(fmt.Sprintf("round-%d", round))
+				assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+				expected[i] = value
+			}
+		}
+	}()
+	assert.Nil(t, db.Merge())
+	close(stop)
+	wg.Wait()
+
+	check := func(db *DB) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for i := 0; i < keys; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if value, ok := expected[i]; ok {
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			} else {
+				assert.Equal(t, ErrKeyNotFind, err)
+			}
+		}
+	}
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+}
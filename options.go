@@ -1,6 +1,10 @@
 package bitcaskkvdb
 
-import "os"
+import (
+	"bitcask/data"
+	"os"
+	"time"
+)
 
 type Options struct {
 	//数据库数据目录
@@ -21,11 +25,62 @@ type Options struct {
 	//索引池个数
 	IndexNum int64
 
+	//ART 和 HashMap 索引选择分片的哈希算法
+	ShardHash ShardHashType
+
+	//自定义的分片哈希函数，不为空时代替 ShardHash
+	ShardHashFunc func(key []byte) uint64
+
 	//启动时是否使用MMap 加载数据
 	MMapOpen bool
 
+	//活跃文件是否使用可写的内存映射，文件预先扩展到 DataFileSize，写入时直接拷贝到映射区域
+	//文件写满或者关闭时截断预留的空间，不支持 B+ 树索引
+	MMapWrite bool
+
+	//旧文件在运行期间保持内存映射用于读取，活跃文件写满时重新映射
+	//读取旧文件中的数据不需要系统调用
+	MMapSealedFiles bool
+
 	//数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	//启动时发现数据文件损坏的处理策略，默认为 RecoverStrict
+	//截断和跳过都会丢弃损坏位置之后的数据，需要显式开启
+	RecoveryMode RecoveryMode
+
+	//启动时同时解码的数据文件个数，解码结果仍然按照文件id的顺序更新索引
+	//每个文件中所有数据的位置在处理之前都暂存在内存中，并发越高占用的内存越多
+	LoadConcurrency int
+
+	//关闭时是否将内存索引保存为快照，启动时加载快照并只重放快照之后写入的数据，不支持 B+ 树索引
+	IndexSnapshot bool
+
+	//开启 IndexSnapshot 时后台定期保存快照的间隔，为 0 表示只在关闭时保存
+	IndexSnapshotInterval time.Duration
+
+	//写入时 Value 的压缩算法，不同算法写入的数据可以混合存在
+	Compression CompressionType
+
+	//加密数据文件、Hint文件和事务序列号文件使用的密钥，为 nil 时不加密
+	//新文件使用当前密钥，更换当前密钥之后旧文件在 Merge 时用新密钥重写
+	EncryptionKeys KeyProvider
+
+	//选择性 Merge 的阈值，为 0 时 Merge 重写所有旧文件
+	//大于 0 时只重写无效数据比例达到该值的文件，此时不再检查 DataFileMergeRatio
+	SelectiveMergeRatio float32
+
+	//后台自动 Merge 的检查间隔，为 0 表示不开启自动 Merge
+	//每次检查时无效数据比例达到 DataFileMergeRatio 才会真正执行
+	AutoMergeInterval time.Duration
+
+	//允许自动 Merge 的时间窗口，取值为距离当天零点的时长
+	//Start > End 表示跨越零点，两者相等表示不限制
+	AutoMergeWindowStart time.Duration
+	AutoMergeWindowEnd   time.Duration
+
+	//进程内同时进行的自动 Merge 个数上限，多个数据库实例共享，为 0 表示不限制
+	MaxConcurrentMerges int
 }
 
 // Iterator配置项
@@ -36,6 +91,15 @@ type IteratorOptions struct {
 	Reverse bool
 }
 
+// Merge 配置项
+type MergeOptions struct {
+	//Merge 时读写数据的速度上限，为 0 表示不限制
+	RateLimitBytesPerSec int64
+
+	//执行进度回调，每处理完一个文件以及 Merge 完成时调用
+	Progress func(MergeProgress)
+}
+
 type WriteBatchOptions struct {
 	//单批次最大数据量
 	MaxBatchNum uint
@@ -55,17 +119,66 @@ const (
 
 	//BPlusTree B+树，将索引存储在磁盘上
 	BPlusTree
+
+	//HashMap 分片哈希表，点查询最快、占用内存最少，遍历时需要复制所有的key并排序
+	HashMap
+)
+
+type ShardHashType = int8
+
+const (
+	//ShardHashFNV FNV-1a 哈希，共享长前缀的key同样分布均匀
+	ShardHashFNV ShardHashType = iota + 1
+
+	//ShardHashSum 所有字节求和，早期版本使用的哈希，分布不均匀
+	ShardHashSum
+)
+
+type RecoveryMode = int8
+
+const (
+	//RecoverStrict 发现任何损坏都无法启动
+	RecoverStrict RecoveryMode = iota
+
+	//RecoverTruncateTail 截断活跃文件尾部写入中断的数据，旧文件损坏时无法启动
+	RecoverTruncateTail
+
+	//RecoverSkipCorrupt 跳过所有损坏的数据，活跃文件尾部的损坏会被截断
+	RecoverSkipCorrupt
+)
+
+type KeyProvider = data.KeyProvider
+
+type CompressionType = data.CompressionType
+
+const (
+	//CompressionNone 不压缩
+	CompressionNone = data.CompressionNone
+
+	//CompressionSnappy Snappy 块格式，压缩和解压速度快
+	CompressionSnappy = data.CompressionSnappy
+
+	//CompressionDeflate 压缩率更高，速度较慢
+	CompressionDeflate = data.CompressionDeflate
+
+	//CompressionZstd Zstandard，压缩率接近 Deflate，解压速度接近 Snappy
+	CompressionZstd = data.CompressionZstd
 )
 
 var DefaultOptions = Options{
-	Dirpath:            os.TempDir(),
-	DataFileSize:       256 * 1024 * 1024,
-	SyncWrites:         false,
-	IndexType:          ART,
-	IndexNum:           10,
-	BytesPerSync:       0,
-	MMapOpen:           true,
-	DataFileMergeRatio: 0.5,
+	Dirpath:             os.TempDir(),
+	DataFileSize:        256 * 1024 * 1024,
+	SyncWrites:          false,
+	IndexType:           ART,
+	IndexNum:            10,
+	ShardHash:           ShardHashFNV,
+	BytesPerSync:        0,
+	MMapOpen:            true,
+	DataFileMergeRatio:  0.5,
+	RecoveryMode:        RecoverStrict,
+	LoadConcurrency:     4,
+	AutoMergeInterval:   0,
+	MaxConcurrentMerges: 1,
 }
 
 var DefalutIteratorOptions = IteratorOptions{
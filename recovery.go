@@ -0,0 +1,121 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"io"
+	"os"
+)
+
+// RecoveryReport 启动时加载数据文件发现的损坏以及处理结果
+type RecoveryReport struct {
+	Corruptions    []Corruption //发现的所有损坏位置
+	TruncatedBytes int64        //活跃文件尾部被截断的字节数
+	SkippedBytes   int64        //被跳过的损坏数据字节数
+}
+
+// Corruption 数据文件中的一处损坏
+type Corruption struct {
+	FileId    uint32
+	Offset    int64 //损坏数据的起始位置
+	Size      int64 //损坏数据的长度
+	Truncated bool  //是否已经从文件中截断
+	Err       error //读取时的错误
+}
+
+// 合并一个数据文件的恢复结果
+func (r *RecoveryReport) merge(other RecoveryReport) {
+	r.Corruptions = append(r.Corruptions, other.Corruptions...)
+	r.TruncatedBytes += other.TruncatedBytes
+	r.SkippedBytes += other.SkippedBytes
+}
+
+// RecoveryReport 返回启动时的数据恢复结果
+func (db *DB) RecoveryReport() RecoveryReport {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	report := db.recovery
+	report.Corruptions = append([]Corruption(nil), db.recovery.Corruptions...)
+	return report
+}
+
+// 加载数据文件时在 offset 处读取失败，根据恢复策略处理，结果记录到 report 中
+// 返回下一条有效数据的位置，返回 -1 表示该文件已经没有可以读取的数据
+func (db *DB) recoverDataFile(report *RecoveryReport, dataFile *data.DataFile, offset, fileSize int64, cause error, isActive bool) (int64, error) {
+	if cause == io.EOF {
+		cause = io.ErrUnexpectedEOF
+	}
+
+	switch db.options.RecoveryMode {
+	case RecoverTruncateTail:
+		//只有活跃文件的尾部可能因为写入中断而损坏，旧文件损坏说明数据目录出了问题
+		if !isActive {
+			return -1, cause
+		}
+		return -1, db.truncateDataFile(report, dataFile, offset, fileSize, cause)
+
+	case RecoverSkipCorrupt:
+		next := findNextRecord(dataFile, offset+1, fileSize)
+		if next < 0 && isActive {
+			return -1, db.truncateDataFile(report, dataFile, offset, fileSize, cause)
+		}
+		end := next
+		if next < 0 {
+			end = fileSize
+		}
+		report.Corruptions = append(report.Corruptions, Corruption{
+			FileId: dataFile.FileId,
+			Offset: offset,
+			Size:   end - offset,
+			Err:    cause,
+		})
+		report.SkippedBytes += end - offset
+		return next, nil
+
+	default:
+		return -1, cause
+	}
+}
+
+// 截断活跃文件尾部损坏的数据，之后的写入从最后一条有效数据之后开始
+func (db *DB) truncateDataFile(report *RecoveryReport, dataFile *data.DataFile, offset, fileSize int64, cause error) error {
+	if err := os.Truncate(data.GetDataFileName(db.options.Dirpath, dataFile.FileId), offset); err != nil {
+		return err
+	}
+	report.Corruptions = append(report.Corruptions, Corruption{
+		FileId:    dataFile.FileId,
+		Offset:    offset,
+		Size:      fileSize - offset,
+		Truncated: true,
+		Err:       cause,
+	})
+	report.TruncatedBytes += fileSize - offset
+	return nil
+}
+
+// 活跃文件从 offset 开始全部为 0 时截断，返回是否截断
+func (db *DB) truncateZeroTail(dataFile *data.DataFile, offset, fileSize int64) (bool, error) {
+	buf := make([]byte, 64*1024)
+	for pos := offset; pos < fileSize; pos += int64(len(buf)) {
+		n := min(int64(len(buf)), fileSize-pos)
+		if _, err := dataFile.IoManager.Read(buf[:n], pos); err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+	}
+	err := os.Truncate(data.GetDataFileName(db.options.Dirpath, dataFile.FileId), offset)
+	return err == nil, err
+}
+
+// 从 offset 开始逐字节查找下一条能够通过校验的数据，找不到时返回 -1
+func findNextRecord(dataFile *data.DataFile, offset, fileSize int64) int64 {
+	for ; offset < fileSize; offset++ {
+		if _, _, err := dataFile.ReadRecord(offset); err == nil {
+			return offset
+		}
+	}
+	return -1
+}
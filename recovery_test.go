@@ -0,0 +1,114 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_RecoveryTruncateTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Close())
+
+	//模拟断电：活跃文件尾部只写入了半条数据
+	encRecord, _ := data.Encode_LogRecord(&data.LogRecord{
+		Key:   LogRecordKeyWithSeq(utils.GetTestKey(100), NonTransactionSewNo),
+		Value: utils.RandomValue(24),
+	})
+	torn := encRecord[:len(encRecord)/2]
+	file, err := os.OpenFile(data.GetDataFileName(dir, 0), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(torn)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	//默认的严格模式下无法启动
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	//截断尾部之后正常启动
+	opts.RecoveryMode = RecoverTruncateTail
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	report := db2.RecoveryReport()
+	assert.Equal(t, int64(len(torn)), report.TruncatedBytes)
+	assert.Equal(t, 1, len(report.Corruptions))
+	assert.True(t, report.Corruptions[0].Truncated)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+
+	//之后的写入接在最后一条有效数据之后
+	assert.Nil(t, db2.Put(utils.GetTestKey(100), []byte("after recovery")))
+	assert.Nil(t, db2.Close())
+
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db3.RecoveryReport().Corruptions))
+	val, err := db3.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after recovery"), val)
+	assert.Equal(t, 101, len(db3.ListKeys()))
+}
+
+func TestDB_RecoverySkipCorrupt(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	//破坏旧文件中第二条数据的 Value
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	_, size := data.Encode_LogRecord(&data.LogRecord{
+		Key:   LogRecordKeyWithSeq(utils.GetTestKey(0), NonTransactionSewNo),
+		Value: utils.RandomValue(64),
+	})
+	content[data.FileHeaderSize+size+size-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	//存在 Hint 文件时启动不扫描数据文件，删除之后才能在启动时发现损坏
+	assert.Nil(t, os.Remove(data.GetHintFileName(dir, 0)))
+
+	//只截断活跃文件尾部时，旧文件损坏无法启动
+	opts.RecoveryMode = RecoverTruncateTail
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCrc, err)
+
+	opts.RecoveryMode = RecoverSkipCorrupt
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	report := db2.RecoveryReport()
+	assert.Equal(t, 1, len(report.Corruptions))
+	assert.Equal(t, size, report.SkippedBytes)
+	assert.Equal(t, uint32(0), report.Corruptions[0].FileId)
+
+	//只丢失了被破坏的那条数据
+	assert.Equal(t, 99, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFind, err)
+
+	//Merge 时同样跳过损坏的数据
+	db2.options.DataFileMergeRatio = 0
+	assert.Nil(t, db2.Merge())
+	assert.Equal(t, 99, len(db2.ListKeys()))
+}
@@ -0,0 +1,173 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"sync"
+	"time"
+)
+
+// Snapshot 数据库在某一时刻的一致性只读视图
+// 快照持有创建时刻的索引副本以及当时所有的数据文件，
+// 在 Release 之前这些数据文件不会被 Merge 删除
+type Snapshot struct {
+	db       *DB
+	seqNo    int64                     //创建快照时的事务序列号
+	mu       *sync.RWMutex             //保护下面的字段，读取时持有读锁，Release 等待正在进行的读取完成
+	index    index.Indexer             //创建快照时的索引副本
+	files    map[uint32]*data.DataFile //创建快照时的所有数据文件
+	released bool
+
+	//复制索引期间被修改的key在创建快照时的位置，nil 表示当时不存在
+	//（只在持有 db.mu 时访问）
+	before map[string]*data.LogRecordPos
+}
+
+// Snapshot 创建一个快照，使用完毕后必须调用 Release
+// BTree 索引使用写时复制，代价为 O(1)；其他类型的索引在释放锁之后逐个拷贝，拷贝期间不阻塞读写
+func (db *DB) Snapshot() *Snapshot {
+	//持有锁期间不会有新的数据写入，保证索引副本和数据文件一致
+	db.mu.Lock()
+	snap := &Snapshot{
+		db:    db,
+		seqNo: db.seqNo,
+		mu:    new(sync.RWMutex),
+		files: db.refDataFiles(),
+	}
+	if bt, ok := db.index.(*index.BTree); ok {
+		snap.index = bt.Clone()
+		db.mu.Unlock()
+		return snap
+	}
+	snap.before = make(map[string]*data.LogRecordPos)
+	db.copyingSnaps[snap] = struct{}{}
+	indexer := db.index
+	db.mu.Unlock()
+
+	//拷贝时索引可能正在被修改，拷贝完成之后用修改之前的位置覆盖这些key
+	bt := index.NewBtree()
+	iter := indexer.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		//B+树返回的key只在读事务内有效，需要拷贝一份
+		key := make([]byte, len(iter.Key()))
+		copy(key, iter.Key())
+		bt.Put(key, iter.Value())
+	}
+	iter.Close()
+
+	db.mu.Lock()
+	delete(db.copyingSnaps, snap)
+	before := snap.before
+	snap.before = nil
+	db.mu.Unlock()
+	for key, pos := range before {
+		if pos == nil {
+			bt.Delete([]byte(key))
+		} else {
+			bt.Put([]byte(key), pos)
+		}
+	}
+	snap.index = bt
+	return snap
+}
+
+// 索引中的 key 将要被修改，为正在拷贝索引的快照保存修改之前的位置
+// （在访问此方法前必须持有 db.mu）
+func (db *DB) saveSnapshotPosLocked(key []byte) {
+	if len(db.copyingSnaps) == 0 {
+		return
+	}
+	pos := db.index.Get(key)
+	for snap := range db.copyingSnaps {
+		if _, ok := snap.before[string(key)]; !ok {
+			snap.before[string(key)] = pos
+		}
+	}
+}
+
+// SeqNo 返回快照对应的事务序列号
+func (s *Snapshot) SeqNo() int64 {
+	return s.seqNo
+}
+
+// Get 读取快照中 key 对应的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	logpos := s.index.Get(key)
+	if logpos == nil || logpos.Expired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFind
+	}
+	return readValueFromFile(s.files[logpos.Fid], logpos)
+}
+
+// NewIterator 创建基于快照的数据迭代器
+// 快照已经释放时返回的迭代器没有数据
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	s.mu.RLock()
+	indexer := s.index
+	s.mu.RUnlock()
+	if indexer == nil {
+		indexer = index.NewBtree()
+	}
+	return &Iterator{
+		db:        s.db,
+		snap:      s,
+		indexIter: indexer.Iterator(opts.Reverse),
+		Options:   opts,
+	}
+}
+
+// Fold 遍历快照中所有的数据，并执行用户指定的操作
+func (s *Snapshot) Fold(f func(key []byte, value []byte) bool) error {
+	s.mu.RLock()
+	released := s.released
+	s.mu.RUnlock()
+	if released {
+		return ErrSnapshotReleased
+	}
+	iter := s.NewIterator(DefalutIteratorOptions)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		if !f(iter.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，解除对数据文件的引用
+// 可以和快照上的读取并发调用，正在进行的读取完成之后才会释放数据文件
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	unrefDataFiles(s.files)
+	s.index = nil
+	s.files = nil
+}
+
+// 根据索引协议从快照的数据文件中获取对应的Value
+func (s *Snapshot) getValueByPostion(logpos *data.LogRecordPos) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	return readValueFromFile(s.files[logpos.Fid], logpos)
+}
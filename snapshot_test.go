@@ -0,0 +1,177 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	for _, tp := range []IndexType{Btree, ART, BPlusTree, HashMap} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.IndexType = tp
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("old"))
+			assert.Nil(t, err)
+		}
+
+		snap := db.Snapshot()
+
+		//快照创建之后的写入对快照不可见
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("new"))
+			assert.Nil(t, err)
+		}
+		err = db.Delete(utils.GetTestKey(0))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(1000), []byte("new"))
+		assert.Nil(t, err)
+
+		val, err := snap.Get(utils.GetTestKey(0))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+		_, err = snap.Get(utils.GetTestKey(1000))
+		assert.Equal(t, ErrKeyNotFind, err)
+
+		var count int
+		err = snap.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, []byte("old"), value)
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 100, count)
+
+		iter := snap.NewIterator(DefalutIteratorOptions)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			value, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("old"), value)
+		}
+		iter.Close()
+
+		//数据库本身读到的是最新数据
+		val, err = db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+
+		snap.Release()
+		_, err = snap.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrSnapshotReleased, err)
+
+		db.Close()
+		destroyDB(db)
+	}
+}
+
+// 使用 -race 运行时检查 Release 和读取之间没有数据竞争
+func TestDB_SnapshotConcurrentRelease(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+	}
+
+	for round := 0; round < 20; round++ {
+		snap := db.Snapshot()
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					val, err := snap.Get(utils.GetTestKey(i))
+					if err == ErrSnapshotReleased {
+						return
+					}
+					assert.Nil(t, err)
+					assert.Equal(t, []byte("old"), val)
+				}
+			}()
+		}
+		snap.Release()
+		wg.Wait()
+
+		_, err := snap.Get(utils.GetTestKey(0))
+		assert.Equal(t, ErrSnapshotReleased, err)
+		assert.Equal(t, ErrSnapshotReleased, snap.Fold(func(key []byte, value []byte) bool { return true }))
+		iter := snap.NewIterator(DefalutIteratorOptions)
+		iter.Rewind()
+		assert.False(t, iter.Valid())
+		iter.Close()
+	}
+	assert.Nil(t, db.Close())
+}
+
+// 拷贝索引期间持续写入，快照中的数据必须是创建快照时刻的状态
+func TestDB_SnapshotConcurrentWrites(t *testing.T) {
+	for _, tp := range []IndexType{ART, HashMap, BPlusTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.IndexType = tp
+		opts.MMapOpen = false
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		const keys = 2000
+		for i := 0; i < keys; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("0")))
+		}
+
+		//按照和遍历相反的顺序一轮一轮地写入，任一时刻前面的key的轮次不大于后面的key，且最多相差一轮
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 1; ; round++ {
+				for i := keys - 1; i >= 0; i-- {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(round))))
+				}
+			}
+		}()
+
+		for s := 0; s < 20; s++ {
+			snap := db.Snapshot()
+			var rounds []int
+			assert.Nil(t, snap.Fold(func(key []byte, value []byte) bool {
+				round, err := strconv.Atoi(string(value))
+				assert.Nil(t, err)
+				rounds = append(rounds, round)
+				return true
+			}))
+			snap.Release()
+			assert.Equal(t, keys, len(rounds))
+			for i := 1; i < len(rounds); i++ {
+				assert.LessOrEqual(t, rounds[i-1], rounds[i])
+			}
+			assert.LessOrEqual(t, rounds[len(rounds)-1]-rounds[0], 1)
+		}
+		close(done)
+		wg.Wait()
+
+		assert.Nil(t, db.Close())
+		destroyDB(db)
+	}
+}
@@ -0,0 +1,306 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/data"
+	"bytes"
+	"sort"
+	"sync/atomic"
+)
+
+// Txn 基于 WriteBatch 的乐观读写事务
+// 读操作记录读过的 key，提交时如果这些 key 在事务开始之后被修改过，则提交失败
+type Txn struct {
+	db         *DB
+	wb         *WriteBatch         //暂存事务中的写操作
+	startSeqNo int64               //事务开始时的序列号
+	reads      map[string]struct{} //事务中读过的key
+	finished   bool                //是否已经提交或回滚
+}
+
+// Begin 开启一个乐观事务
+func (db *DB) Begin() *Txn {
+	txn := &Txn{
+		db:    db,
+		wb:    db.NewWriteBatch(DefalutWriteBatchOptions),
+		reads: make(map[string]struct{}),
+	}
+
+	db.mu.Lock()
+	txn.startSeqNo = db.seqNo
+	db.activeTxns[txn] = struct{}{}
+	db.mu.Unlock()
+	return txn
+}
+
+// Get 读取数据，优先读取事务中尚未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.wb.mu.Lock()
+	if txn.finished {
+		txn.wb.mu.Unlock()
+		return nil, ErrTxnClosed
+	}
+	if record, ok := txn.wb.pendingWrites[string(key)]; ok {
+		txn.wb.mu.Unlock()
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFind
+		}
+		return record.Value, nil
+	}
+	txn.reads[string(key)] = struct{}{}
+	txn.wb.mu.Unlock()
+
+	return txn.db.Get(key)
+}
+
+// Put 在事务中写入数据
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if txn.isFinished() {
+		return ErrTxnClosed
+	}
+	return txn.wb.Put(key, value)
+}
+
+// Delete 在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if txn.isFinished() {
+		return ErrTxnClosed
+	}
+	return txn.wb.Delete(key)
+}
+
+// Commit 检查冲突并提交事务，存在冲突时返回 ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.wb.mu.Lock()
+	defer txn.wb.mu.Unlock()
+	if txn.finished {
+		return ErrTxnClosed
+	}
+
+	db := txn.db
+	defer func() {
+		db.mu.Lock()
+		db.finishTxnLocked(txn)
+		db.mu.Unlock()
+	}()
+
+	//读过的 key 在事务开始后被修改过，说明发生了冲突
+	//（在访问此方法前必须持有 db.mu）
+	checkConflict := func() error {
+		for key := range txn.reads {
+			if seqNo, ok := db.recentWrites[key]; ok && seqNo > txn.startSeqNo {
+				return ErrTxnConflict
+			}
+		}
+		return nil
+	}
+
+	if len(txn.wb.pendingWrites) == 0 {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return checkConflict()
+	}
+	if len(txn.wb.pendingWrites) > int(txn.wb.options.MaxBatchNum) {
+		return ErrExceedMaxBatchNum
+	}
+	return db.commit(txn.wb.newCommitRequest(checkConflict))
+}
+
+// Rollback 放弃事务中所有的写入
+func (txn *Txn) Rollback() {
+	txn.wb.mu.Lock()
+	defer txn.wb.mu.Unlock()
+	if txn.finished {
+		return
+	}
+	txn.db.mu.Lock()
+	txn.db.finishTxnLocked(txn)
+	txn.db.mu.Unlock()
+	txn.wb.pendingWrites = make(map[string]*data.LogRecord)
+}
+
+func (txn *Txn) isFinished() bool {
+	txn.wb.mu.Lock()
+	defer txn.wb.mu.Unlock()
+	return txn.finished
+}
+
+// 结束事务，并清理不再需要的修改记录
+// （在访问此方法前必须持有 db.mu）
+func (db *DB) finishTxnLocked(txn *Txn) {
+	txn.finished = true
+	if _, ok := db.activeTxns[txn]; !ok {
+		return
+	}
+	delete(db.activeTxns, txn)
+
+	if len(db.activeTxns) == 0 {
+		db.recentWrites = make(map[string]int64)
+		return
+	}
+
+	//比最早的活跃事务还要旧的修改不会再引起冲突
+	minSeqNo := int64(-1)
+	for t := range db.activeTxns {
+		if minSeqNo < 0 || t.startSeqNo < minSeqNo {
+			minSeqNo = t.startSeqNo
+		}
+	}
+	for key, seqNo := range db.recentWrites {
+		if seqNo <= minSeqNo {
+			delete(db.recentWrites, key)
+		}
+	}
+}
+
+// 非事务写入完成后，如果存在活跃事务，则分配新的序列号并记录被修改的key
+// （在访问此方法前必须持有 db.mu）
+func (db *DB) trackWriteLocked(key []byte) {
+	if len(db.activeTxns) == 0 {
+		return
+	}
+	db.recentWrites[string(key)] = atomic.AddInt64(&db.seqNo, 1)
+}
+
+// 记录被修改的key，没有活跃事务时无需记录
+// （在访问此方法前必须持有 db.mu）
+func (db *DB) trackSeqWriteLocked(seqNo int64, key string) {
+	if len(db.activeTxns) == 0 {
+		return
+	}
+	db.recentWrites[key] = seqNo
+}
+
+// TxnIterator 事务迭代器，合并事务中尚未提交的写入和数据库中的数据
+type TxnIterator struct {
+	txn         *Txn
+	dbIter      *Iterator
+	pending     []*data.LogRecord //按遍历顺序排好序的暂存数据
+	pendIndex   int
+	fromPending bool //当前位置的数据是否来自暂存数据
+	valid       bool
+	reverse     bool
+}
+
+// Iterator 创建事务迭代器，遍历到的数据库中的key会计入读集合
+func (txn *Txn) Iterator(opts IteratorOptions) *TxnIterator {
+	txn.wb.mu.Lock()
+	pending := make([]*data.LogRecord, 0, len(txn.wb.pendingWrites))
+	for _, record := range txn.wb.pendingWrites {
+		if bytes.HasPrefix(record.Key, opts.Prefix) {
+			pending = append(pending, record)
+		}
+	}
+	txn.wb.mu.Unlock()
+
+	it := &TxnIterator{
+		txn:     txn,
+		dbIter:  txn.db.NewIterator(opts),
+		pending: pending,
+		reverse: opts.Reverse,
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return it.compare(pending[i].Key, pending[j].Key) < 0
+	})
+	it.Rewind()
+	return it
+}
+
+// 按照遍历方向比较两个key
+func (it *TxnIterator) compare(a, b []byte) int {
+	if it.reverse {
+		return bytes.Compare(b, a)
+	}
+	return bytes.Compare(a, b)
+}
+
+// 重新回到迭代器的起点，即第一个数据
+func (it *TxnIterator) Rewind() {
+	it.dbIter.Rewind()
+	it.pendIndex = 0
+	it.settle()
+}
+
+// 根据传入的key，跳转到>= 或（<=）key的第一个位置
+func (it *TxnIterator) Seek(key []byte) {
+	it.dbIter.Seek(key)
+	it.pendIndex = sort.Search(len(it.pending), func(i int) bool {
+		return it.compare(it.pending[i].Key, key) >= 0
+	})
+	it.settle()
+}
+
+// 跳转到下一个key
+func (it *TxnIterator) Next() {
+	if it.fromPending {
+		it.pendIndex++
+	} else {
+		it.dbIter.Next()
+	}
+	it.settle()
+}
+
+// 是否有效，是否已经遍历完所有的key，用于退出遍历
+func (it *TxnIterator) Valid() bool {
+	return it.valid
+}
+
+// 返回当前位置的Key
+func (it *TxnIterator) Key() []byte {
+	if it.fromPending {
+		return it.pending[it.pendIndex].Key
+	}
+	return it.dbIter.Key()
+}
+
+// 返回当前位置的Value数据
+func (it *TxnIterator) Value() ([]byte, error) {
+	if it.fromPending {
+		return it.pending[it.pendIndex].Value, nil
+	}
+	return it.dbIter.Value()
+}
+
+// 关闭迭代器，释放相应资源
+func (it *TxnIterator) Close() {
+	it.dbIter.Close()
+}
+
+// 定位到下一个有效位置：暂存数据覆盖数据库中相同的key，暂存的删除操作会跳过该key
+func (it *TxnIterator) settle() {
+	for {
+		dbValid := it.dbIter.Valid()
+		pendValid := it.pendIndex < len(it.pending)
+		if !dbValid && !pendValid {
+			it.valid = false
+			return
+		}
+
+		if pendValid {
+			record := it.pending[it.pendIndex]
+			cmp := -1
+			if dbValid {
+				cmp = it.compare(record.Key, it.dbIter.Key())
+			}
+			if cmp <= 0 {
+				if cmp == 0 {
+					it.dbIter.Next()
+				}
+				if record.Type == data.LogRecordDeleted {
+					it.pendIndex++
+					continue
+				}
+				it.fromPending, it.valid = true, true
+				return
+			}
+		}
+
+		it.fromPending, it.valid = false, true
+		it.txn.wb.mu.Lock()
+		it.txn.reads[string(it.dbIter.Key())] = struct{}{}
+		it.txn.wb.mu.Unlock()
+		return
+	}
+}
@@ -0,0 +1,198 @@
+package bitcaskkvdb
+
+import (
+	"bitcask/utils"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Txn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 64 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("100"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("0"))
+	assert.Nil(t, err)
+
+	//1、读到自己未提交的写入，提交前其他人不可见
+	txn := db.Begin()
+	val, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("100"), val)
+	err = txn.Put(utils.GetTestKey(1), []byte("50"))
+	assert.Nil(t, err)
+	err = txn.Put(utils.GetTestKey(2), []byte("50"))
+	assert.Nil(t, err)
+	val, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("50"), val)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("100"), val)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("50"), val)
+	assert.Equal(t, ErrTxnClosed, txn.Put(utils.GetTestKey(3), nil))
+
+	//2、读过的key在事务开始后被修改，提交失败
+	txn1 := db.Begin()
+	txn2 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, txn1.Put(utils.GetTestKey(1), []byte("10")))
+	assert.Nil(t, txn2.Put(utils.GetTestKey(1), []byte("20")))
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), val)
+
+	//3、非事务写入同样会引起冲突
+	txn3 := db.Begin()
+	_, err = txn3.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("1")))
+	assert.Nil(t, txn3.Put(utils.GetTestKey(3), []byte("1")))
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFind, err)
+
+	//4、只写不读的事务不会冲突
+	txn4 := db.Begin()
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("2")))
+	assert.Nil(t, txn4.Put(utils.GetTestKey(2), []byte("3")))
+	assert.Nil(t, txn4.Commit())
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3"), val)
+	assert.Equal(t, 0, len(db.activeTxns))
+	assert.Equal(t, 0, len(db.recentWrites))
+}
+
+func TestTxn_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go")
+	opts.Dirpath = dir
+	opts.DataFileSize = 64 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"a", "c", "e"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("db")))
+	}
+
+	txn := db.Begin()
+	assert.Nil(t, txn.Put([]byte("b"), []byte("txn")))
+	assert.Nil(t, txn.Put([]byte("c"), []byte("txn")))
+	assert.Nil(t, txn.Delete([]byte("e")))
+
+	var keys, values []string
+	iter := txn.Iterator(DefalutIteratorOptions)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		assert.Nil(t, err)
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(value))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, []string{"db", "txn", "txn"}, values)
+
+	keys = nil
+	iteropts := DefalutIteratorOptions
+	iteropts.Reverse = true
+	iter = txn.Iterator(iteropts)
+	for iter.Seek([]byte("b")); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"b", "a"}, keys)
+
+	//遍历过的key被修改后提交失败
+	assert.Nil(t, db.Put([]byte("a"), []byte("new")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+}
+
+// 和事务提交并发的非事务写入，要么排在提交之后覆盖事务的写入，要么让提交因为冲突而失败
+// 开启 SyncWrites 时非事务写入和事务提交在同一组中写入
+func TestTxn_ConflictWithConcurrentWrite(t *testing.T) {
+	for _, syncWrites := range []bool{false, true} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go")
+		opts.Dirpath = dir
+		opts.SyncWrites = syncWrites
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		key := utils.GetTestKey(1)
+		for round := 0; round < 1000; round++ {
+			assert.Nil(t, db.Put(key, []byte("base")))
+			txn := db.Begin()
+			_, err := txn.Get(key)
+			assert.Nil(t, err)
+			assert.Nil(t, txn.Put(key, []byte("txn")))
+
+			//开启 SyncWrites 时先占住写入令牌，让所有请求进入同一组
+			if syncWrites {
+				db.commitToken <- struct{}{}
+			}
+			//事务提交和非事务写入轮流以不同的顺序开始
+			var commitErr error
+			var wg sync.WaitGroup
+			for w := 0; w < 5; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					switch w {
+					case round % 5:
+						commitErr = txn.Commit()
+					case (round + 1) % 5:
+						assert.Nil(t, db.Delete(key))
+					default:
+						assert.Nil(t, db.Put(key, []byte("put")))
+					}
+				}(w)
+			}
+			if syncWrites {
+				for queued := 0; queued < 5; {
+					runtime.Gosched()
+					db.commitMu.Lock()
+					queued = len(db.commitQueue)
+					db.commitMu.Unlock()
+				}
+				<-db.commitToken
+			}
+			wg.Wait()
+
+			if commitErr == ErrTxnConflict {
+				continue
+			}
+			assert.Nil(t, commitErr)
+			//提交成功说明所有非事务写入都排在提交之后，事务写入的值已经被覆盖
+			val, err := db.Get(key)
+			if err != ErrKeyNotFind {
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("put"), val)
+			}
+		}
+		destroyDB(db)
+	}
+}
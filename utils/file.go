@@ -36,6 +36,16 @@ func AvailableDiskSize() (uint64, error) {
 	return stat.Bavail * uint64(stat.Bsize), nil
 }
 
+// SyncDir 持久化目录，保证目录中文件的创建、删除和重命名在崩溃之后依然有效
+func SyncDir(dirpath string) error {
+	dir, err := os.Open(dirpath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
 // CopyDir 拷贝数据目录
 func CopyDir(src, dest string, exclude []string) error {
 	//目标目录不存在则创建